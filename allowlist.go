@@ -0,0 +1,195 @@
+package gblist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net"
+	"strings"
+	"time"
+)
+
+// allowlistBucket is the name of the bucket containing the IPs and networks
+// that must never be listed.
+const allowlistBucket = "_allowlist"
+
+// Allowed is an entry of the allowlist.
+// IP: the IP or CIDR it applies to.
+// Description: why it's allowed (e.g. "office").
+// CreatedAt: when it was added.
+type Allowed struct {
+	IP          string
+	Description string
+	CreatedAt   time.Time
+}
+
+// allowlist is the allowlist as loaded within a transaction
+type allowlist []*net.IPNet
+
+// AllowlistError is returned for the records that were not written
+// because their IP is in the allowlist.
+type AllowlistError struct {
+	IPs []string
+}
+
+func (e *AllowlistError) Error() string {
+	if len(e.IPs) == 1 {
+		return fmt.Sprintf("%s is in the allowlist", e.IPs[0])
+	}
+	return fmt.Sprintf("%s are in the allowlist", strings.Join(e.IPs, ", "))
+}
+
+// Allow adds an IP or CIDR to the allowlist, replacing the existing entry.
+// The non expired records overlapping it are removed from every bucket, in
+// the same transaction; from then on records overlapping it are neither
+// added nor returned by lookups.
+func (s *Storage) Allow(ip string, description string) error {
+	ip = strings.TrimSpace(ip)
+	valid, err := IsValid(ip)
+	if !valid {
+		return err
+	}
+	network, _ := ParseNetwork(ip)
+	entry := Allowed{
+		IP:          ip,
+		Description: strings.TrimSpace(description),
+		CreatedAt:   time.Now(),
+	}
+	payload, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(allowlistBucket))
+		if err == nil {
+			err = b.Put([]byte(ip), payload)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(func(name []byte, records *bolt.Bucket) error {
+			bucket := string(name)
+			if isReserved(bucket) {
+				return nil
+			}
+			var removed []Record
+			records.ForEach(func(k, v []byte) error {
+				record, err := decodeRecord(k, v)
+				if err == nil && record.IsValid() && (allowlist{network}).contains(record.IP) {
+					removed = append(removed, record)
+				}
+				return nil
+			})
+			for _, record := range removed {
+				err := records.Delete([]byte(record.IP))
+				if err == nil {
+					err = s.logChange(tx, bucket, ActionRemove, record)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Disallow removes an IP or CIDR from the allowlist; records removed when it
+// was allowed are not restored.
+func (s *Storage) Disallow(ip string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(allowlistBucket))
+		if b == nil || b.Get([]byte(ip)) == nil {
+			return errors.New(fmt.Sprintf("%s is not in the allowlist", ip))
+		}
+		return b.Delete([]byte(ip))
+	})
+}
+
+// Allowlist returns the entries of the allowlist.
+func (s *Storage) Allowlist() ([]Allowed, error) {
+	var entries []Allowed
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(allowlistBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry Allowed
+			if json.Unmarshal(v, &entry) == nil {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// IsAllowed returns if the IP or CIDR overlaps an entry of the allowlist.
+func (s *Storage) IsAllowed(ip string) (bool, error) {
+	var allowed bool
+	err := s.view(func(tx *bolt.Tx) error {
+		allowed = loadAllowlist(tx).contains(ip)
+		return nil
+	})
+	return allowed, err
+}
+
+// loadAllowlist returns the networks of the allowlist
+func loadAllowlist(tx *bolt.Tx) allowlist {
+	var list allowlist
+	b := tx.Bucket([]byte(allowlistBucket))
+	if b == nil {
+		return list
+	}
+	b.ForEach(func(k, v []byte) error {
+		network, err := ParseNetwork(string(k))
+		if err == nil {
+			list = append(list, network)
+		}
+		return nil
+	})
+	return list
+}
+
+// contains returns if the IP or CIDR overlaps any of the networks: a banned
+// network including an allowed IP would block it all the same.
+func (a allowlist) contains(ip string) bool {
+	if len(a) == 0 {
+		return false
+	}
+	network, err := ParseNetwork(ip)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range a {
+		if allowed.Contains(network.IP) || network.Contains(allowed.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetwork parses an IP or CIDR as a network; a single IP is a network
+// with a full mask.
+func ParseNetwork(ip string) (*net.IPNet, error) {
+	if strings.Contains(ip, "/") {
+		_, network, err := net.ParseCIDR(ip)
+		return network, err
+	}
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil, errors.New(fmt.Sprintf("%s is not a valid IP address", ip))
+	}
+	if v4 := address.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: address, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// isReserved returns if the bucket is used by the storage itself rather than
+// for records.
+func isReserved(bucket string) bool {
+	return bucket == historyBucket || bucket == allowlistBucket
+}
@@ -0,0 +1,97 @@
+package gblist
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_Allow(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.0/24", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("198.51.100.1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.Allow("192.0.2.10", "office")
+	if err != nil {
+		t.Error(err)
+	}
+	record, err := s.Fetch(BUCKET, "192.0.2.0/24")
+	if err != nil {
+		t.Error(err)
+	}
+	if record.IsValid() {
+		t.Errorf("network containing an allowed IP still listed")
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.10", "", ttl, t))
+	if err == nil {
+		t.Errorf("allowed IP added")
+	}
+	err = s.AddBatch(BUCKET, []Record{createRecord("192.0.2.10", "", ttl, t), createRecord("203.0.113.1", "", ttl, t)})
+	if allowlisted, ok := err.(*AllowlistError); !ok || len(allowlisted.IPs) != 1 || allowlisted.IPs[0] != "192.0.2.10" {
+		t.Errorf("wrong error for a batch with an allowed IP: %v", err)
+	}
+	writer := s.NewBatchWriter(BUCKET, 1, 0)
+	err = writer.Add(createRecord("192.0.2.10", "", ttl, t))
+	if err == nil || err.Error() != "192.0.2.10 is in the allowlist" {
+		t.Errorf("wrong error for an allowed IP written in batches: %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("wrong number of records listed %d", len(list))
+	}
+	entries, err := s.Allowlist()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].IP != "192.0.2.10" || entries[0].Description != "office" {
+		t.Errorf("wrong allowlist %+v", entries)
+	}
+	names, err := s.Buckets()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("wrong buckets %v", names)
+	}
+
+	err = s.Disallow("192.0.2.10")
+	if err != nil {
+		t.Error(err)
+	}
+	allowed, err := s.IsAllowed("192.0.2.10")
+	if err != nil {
+		t.Error(err)
+	}
+	if allowed {
+		t.Errorf("IP still allowed")
+	}
+	err = s.Disallow("192.0.2.10")
+	if err == nil {
+		t.Errorf("removed IP not in the allowlist")
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,149 @@
+package gblist
+
+import (
+	"github.com/boltdb/bolt"
+	"sync"
+	"time"
+)
+
+// AddBatch inserts or replaces the given records in the bucket in a single
+// transaction, skipping those in the allowlist: once the others are written
+// their IPs are returned with an *AllowlistError. If any of the records is
+// not valid nothing is written.
+func (s *Storage) AddBatch(bucket string, records []Record) error {
+	for _, record := range records {
+		valid, err := IsValid(record.IP)
+		if !valid {
+			return err
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	var skipped []string
+	err := s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		allowed := loadAllowlist(tx)
+		for _, record := range records {
+			if allowed.contains(record.IP) {
+				skipped = append(skipped, record.IP)
+				continue
+			}
+			_, err = s.put(tx, bucket, b, record, allowed)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && len(skipped) > 0 {
+		err = &AllowlistError{IPs: skipped}
+	}
+	return err
+}
+
+// BatchWriter groups the records added to a bucket and writes them with
+// AddBatch once there are enough of them, or some time after the first
+// one was buffered, whichever comes first.
+// It's safe for concurrent use; Close must be called to write what is left.
+type BatchWriter struct {
+	storage  *Storage
+	bucket   string
+	size     int
+	interval time.Duration
+	mutex    sync.Mutex
+	records  []Record
+	timer    *time.Timer
+	err      error    // From a flush triggered by the timer
+	skipped  []string // IPs in the allowlist, not reported yet
+}
+
+// NewBatchWriter returns a writer committing every size records or after
+// the given interval (a zero interval disables the timer).
+func (s *Storage) NewBatchWriter(bucket string, size int, interval time.Duration) *BatchWriter {
+	if size < 1 {
+		size = 1
+	}
+	return &BatchWriter{
+		storage:  s,
+		bucket:   bucket,
+		size:     size,
+		interval: interval,
+	}
+}
+
+// Add buffers the record, writing the batch if it's full.
+// Errors from writes triggered by the timer, and the records skipped
+// because in the allowlist (as an *AllowlistError), are returned by the
+// next call.
+func (w *BatchWriter) Add(record Record) error {
+	valid, err := IsValid(record.IP)
+	if !valid {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.records = append(w.records, record)
+	if len(w.records) >= w.size {
+		err = w.flush()
+		if err == nil {
+			err = w.takeError()
+		}
+		return err
+	}
+	if w.interval > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			w.err = w.flush()
+		})
+	}
+	return w.takeError()
+}
+
+// Flush writes the buffered records.
+func (w *BatchWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.flush()
+	if err == nil {
+		err = w.takeError()
+	}
+	return err
+}
+
+// Close writes the buffered records; the writer should not be used afterwards.
+func (w *BatchWriter) Close() error {
+	return w.Flush()
+}
+
+// flush writes the buffered records; the mutex must be held.
+func (w *BatchWriter) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	records := w.records
+	w.records = nil
+	err := w.storage.AddBatch(w.bucket, records)
+	if allowlisted, ok := err.(*AllowlistError); ok {
+		w.skipped = append(w.skipped, allowlisted.IPs...)
+		err = nil
+	}
+	return err
+}
+
+// takeError returns (and clears) the error of the last timed flush or,
+// failing that, the records skipped so far; the mutex must be held.
+func (w *BatchWriter) takeError() error {
+	err := w.err
+	w.err = nil
+	if err == nil && len(w.skipped) > 0 {
+		err = &AllowlistError{IPs: w.skipped}
+		w.skipped = nil
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package gblist
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBatchWriter(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+
+	writer := s.NewBatchWriter(BUCKET, 2, time.Millisecond)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		err = writer.Add(createRecord(ip, "", ttl, t))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// The first two are written as the batch is full
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) < 2 {
+		t.Errorf("wrong number of elements %d", len(list))
+	}
+	// The third one by the timer
+	time.Sleep(50 * time.Millisecond)
+	list, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("wrong number of elements %d", len(list))
+	}
+
+	err = writer.Add(Record{IP: "not an IP"})
+	if err == nil {
+		t.Errorf("invalid record accepted")
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.AddBatch(BUCKET, []Record{createRecord("10.0.0.4", "", ttl, t), {IP: "8888"}})
+	if err == nil {
+		t.Errorf("invalid record accepted")
+	}
+	list, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("batch with invalid record was written")
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkStorage_Add(b *testing.B) {
+	s, records := benchmarkSetup(b)
+	b.ResetTimer()
+	for _, record := range records {
+		err := s.Add(BUCKET, record)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	benchmarkTeardown(b, s)
+}
+
+func BenchmarkStorage_AddBatch(b *testing.B) {
+	s, records := benchmarkSetup(b)
+	b.ResetTimer()
+	err := s.AddBatch(BUCKET, records)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	benchmarkTeardown(b, s)
+}
+
+func BenchmarkBatchWriter(b *testing.B) {
+	s, records := benchmarkSetup(b)
+	b.ResetTimer()
+	writer := s.NewBatchWriter(BUCKET, 1000, time.Second)
+	for _, record := range records {
+		err := writer.Add(record)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	benchmarkTeardown(b, s)
+}
+
+// benchmarkSetup opens the database and creates b.N records
+func benchmarkSetup(b *testing.B) (Storage, []Record) {
+	s, err := Open(DB, time.Hour)
+	if err != nil {
+		b.Fatal(err)
+	}
+	records := make([]Record, b.N)
+	for i := range records {
+		records[i], err = New(fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff), time.Hour, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s, records
+}
+
+func benchmarkTeardown(b *testing.B, s Storage) {
+	s.Close()
+	err := os.Remove(DB)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
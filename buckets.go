@@ -0,0 +1,250 @@
+package gblist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strings"
+	"time"
+)
+
+// Stats is a summary of the content of a bucket.
+// Active: records that have not expired yet.
+// Expired: records whose expiration time has passed, but are still stored.
+// IPv4, IPv6 and CIDR count the active records only.
+// EarliestExpiration and LatestExpiration are the expiration times of the
+// active records closest and farthest in the future (zero if there are none).
+// Countries and ASNs count the active records by country and autonomous
+// system, when known.
+type Stats struct {
+	Bucket             string
+	Active             int
+	Expired            int
+	IPv4               int
+	IPv6               int
+	CIDR               int
+	EarliestExpiration time.Time
+	LatestExpiration   time.Time
+	Countries          map[string]int
+	ASNs               map[uint]int
+}
+
+// Buckets returns the names of the buckets of records in the database.
+func (s *Storage) Buckets() ([]string, error) {
+	var names []string
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !isReserved(string(name)) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Stats returns a summary of the records in the given bucket.
+// Unlike List and Dump it does not purge anything from the database.
+func (s *Storage) Stats(bucket string) (Stats, error) {
+	stats := Stats{
+		Bucket:    bucket,
+		Countries: make(map[string]int),
+		ASNs:      make(map[uint]int),
+	}
+	now := time.Now()
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return errors.New(fmt.Sprintf("no %s bucket found", bucket))
+		}
+		allowed := loadAllowlist(tx)
+		return b.ForEach(func(k, v []byte) error {
+			record, err := decodeRecord(k, v)
+			if err != nil {
+				return nil // Dump will purge it, eventually
+			}
+			if valid, _ := IsValid(record.IP); !valid || allowed.contains(record.IP) {
+				return nil
+			}
+			if !now.Before(record.ExpirationTime) {
+				stats.Expired++
+				return nil
+			}
+			stats.Active++
+			if strings.Contains(record.IP, ":") {
+				stats.IPv6++
+			} else {
+				stats.IPv4++
+			}
+			if strings.Contains(record.IP, "/") {
+				stats.CIDR++
+			}
+			if len(record.Country) > 0 {
+				stats.Countries[record.Country]++
+			}
+			if record.ASN != 0 {
+				stats.ASNs[record.ASN]++
+			}
+			if stats.EarliestExpiration.IsZero() || record.ExpirationTime.Before(stats.EarliestExpiration) {
+				stats.EarliestExpiration = record.ExpirationTime
+			}
+			if record.ExpirationTime.After(stats.LatestExpiration) {
+				stats.LatestExpiration = record.ExpirationTime
+			}
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// DeleteBucket removes the given bucket and all its records, which are
+// recorded as removed in its history (that is kept).
+func (s *Storage) DeleteBucket(bucket string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || isReserved(bucket) {
+			return errors.New(fmt.Sprintf("no %s bucket found", bucket))
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			record, err := decodeRecord(k, v)
+			if err == nil && record.IsValid() {
+				err = s.logChange(tx, bucket, ActionRemove, record)
+			}
+			return err
+		})
+		if err == nil {
+			err = tx.DeleteBucket([]byte(bucket))
+		}
+		return err
+	})
+}
+
+// CopyBucket copies all the records from one bucket into another, creating it
+// if necessary. Records already present in the destination with the same IP
+// are overwritten.
+func (s *Storage) CopyBucket(from string, to string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return s.copyBucket(tx, from, to, true)
+	})
+}
+
+// RenameBucket renames a bucket, together with its history. It fails if a
+// bucket with the new name already exists.
+func (s *Storage) RenameBucket(from string, to string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(to)) != nil {
+			return errors.New(fmt.Sprintf("bucket %s already exists", to))
+		}
+		err := s.copyBucket(tx, from, to, false)
+		if err == nil {
+			err = tx.DeleteBucket([]byte(from))
+		}
+		history := tx.Bucket([]byte(historyBucket))
+		if err == nil && history != nil && history.Bucket([]byte(from)) != nil {
+			err = moveHistory(history, from, to)
+			if err == nil {
+				err = s.pruneHistory(history.Bucket([]byte(to)))
+			}
+		}
+		return err
+	})
+}
+
+// copyBucket copies the content of a bucket into another within the given
+// transaction, recording the copied records in the history of the destination
+// if asked. Watchers are always notified.
+func (s *Storage) copyBucket(tx *bolt.Tx, from string, to string, history bool) error {
+	if from == to {
+		return errors.New(fmt.Sprintf("cannot copy bucket %s onto itself", from))
+	}
+	for _, name := range []string{from, to} {
+		if isReserved(name) {
+			return errors.New(fmt.Sprintf("bucket %s is reserved", name))
+		}
+	}
+	src := tx.Bucket([]byte(from))
+	if src == nil {
+		return errors.New(fmt.Sprintf("no %s bucket found", from))
+	}
+	dst, err := tx.CreateBucketIfNotExists([]byte(to))
+	if err != nil {
+		return err
+	}
+	allowed := loadAllowlist(tx)
+	return src.ForEach(func(k, v []byte) error {
+		record, decodeErr := decodeRecord(k, v)
+		if decodeErr == nil && record.IsValid() {
+			if history {
+				_, err = s.put(tx, to, dst, record, allowed)
+				return err
+			}
+			s.notify(tx, from, ActionRemove, record)
+			s.notify(tx, to, ActionAdd, record)
+		}
+		return dst.Put(k, v)
+	})
+}
+
+// moveHistory renames the history of a bucket. If there's already some
+// under the new name (left by a deleted bucket) the events are merged by
+// time and renumbered, so that they are still oldest first.
+func moveHistory(parent *bolt.Bucket, from string, to string) error {
+	var events [][]byte
+	collect := func(name string) ([][]byte, []time.Time, error) {
+		var payloads [][]byte
+		var stamps []time.Time
+		b := parent.Bucket([]byte(name))
+		if b == nil {
+			return nil, nil, nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			var event Event
+			json.Unmarshal(v, &event) // Zero time if not decoded, kept first
+			payloads = append(payloads, append([]byte{}, v...))
+			stamps = append(stamps, event.Time)
+			return nil
+		})
+		return payloads, stamps, err
+	}
+	existing, existingTimes, err := collect(to)
+	if err != nil {
+		return err
+	}
+	moved, movedTimes, err := collect(from)
+	if err != nil {
+		return err
+	}
+	i, j := 0, 0
+	for i < len(existing) || j < len(moved) {
+		if j == len(moved) || (i < len(existing) && !existingTimes[i].After(movedTimes[j])) {
+			events = append(events, existing[i])
+			i++
+		} else {
+			events = append(events, moved[j])
+			j++
+		}
+	}
+	for _, name := range []string{from, to} {
+		if parent.Bucket([]byte(name)) != nil {
+			err = parent.DeleteBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	dst, err := parent.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	for _, payload := range events {
+		sequence, err := dst.NextSequence()
+		if err == nil {
+			err = dst.Put(historyKey(sequence), payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package gblist
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_Buckets(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("193.22.0.0/16", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("2001:db8::1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("10.55.11.12", "", time.Duration(1), t))
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Duration(5))
+
+	stats, err := s.Stats(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if stats.Active != 2 || stats.Expired != 1 || stats.IPv4 != 1 || stats.IPv6 != 1 || stats.CIDR != 1 {
+		t.Errorf("wrong statistics %+v", stats)
+	}
+
+	err = s.CopyBucket(BUCKET, "copy")
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.RenameBucket("copy", BUCKET)
+	if err == nil {
+		t.Errorf("renamed bucket onto an existing one")
+	}
+	err = s.RenameBucket("copy", "renamed")
+	if err != nil {
+		t.Error(err)
+	}
+	names, err := s.Buckets()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(names) != 2 || names[0] != "renamed" || names[1] != BUCKET {
+		t.Errorf("wrong buckets %v", names)
+	}
+	list, err := s.List("renamed")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("wrong number of elements %d", len(list))
+	}
+
+	err = s.DeleteBucket("renamed")
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.DeleteBucket("renamed")
+	if err == nil {
+		t.Errorf("deleted a missing bucket")
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorage_RenameBucket_History(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add("source", createRecord("192.0.2.1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	// The history of a deleted bucket is kept, and found by the renamed one
+	err = s.Add("target", createRecord("192.0.2.2", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.DeleteBucket("target")
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add("source", createRecord("192.0.2.3", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.RenameBucket("source", "target")
+	if err != nil {
+		t.Error(err)
+	}
+	events, err := s.History("target", "")
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []string{"add 192.0.2.1", "add 192.0.2.2", "remove 192.0.2.2", "add 192.0.2.3"}
+	if len(events) != len(expected) {
+		t.Fatalf("wrong history %+v", events)
+	}
+	for i, event := range events {
+		if event.Action+" "+event.IP != expected[i] {
+			t.Errorf("wrong event %d %+v (expected %s)", i, event, expected[i])
+		}
+	}
+	events, err = s.History("source", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("history left under the old name %+v", events)
+	}
+
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var recordTemplate = template.Must(template.New("dump").Funcs(template.FuncMap{"join": strings.Join}).Parse("IP: {{.IP}}\nExpiration time: {{.ExpirationTime}}\nDescription: \"{{.Description}}\"\n{{if .Source}}Source: {{.Source}}\n{{end}}{{if .Rule}}Rule: {{.Rule}}\n{{end}}{{if .CreatedAt}}Created: {{.CreatedAt}}\nUpdated: {{.UpdatedAt}}\n{{end}}Hits: {{.Hits}}\n{{if .Tags}}Tags: {{join .Tags \", \"}}\n{{end}}{{range $k, $v := .Meta}}{{$k}}: {{$v}}\n{{end}}{{if .Country}}Country: {{.Country}}\n{{end}}{{if .ASN}}AS: {{.ASN}} {{.Organization}}\n{{end}}\n"))
+
+var statsTemplate = template.Must(template.New("stats").Parse("Bucket: {{.Bucket}}\nActive: {{.Active}}\nExpired: {{.Expired}}\nIPv4: {{.IPv4}}\nIPv6: {{.IPv6}}\nCIDR: {{.CIDR}}\nEarliest expiration: {{.EarliestExpiration}}\nLatest expiration: {{.LatestExpiration}}\n{{range $k, $v := .Countries}}Country {{$k}}: {{$v}}\n{{end}}{{range $k, $v := .ASNs}}AS {{$k}}: {{$v}}\n{{end}}\n"))
+
+var ipTemplate = template.Must(template.New("list").Parse("{{.IP}}\n"))
+
+var importTemplate = template.Must(template.New("import").Parse("{{.Source}}: {{.Accepted}} accepted, {{.Rejected}} rejected, {{.Duplicates}} duplicates\n"))
+
+var eventTemplate = template.Must(template.New("history").Parse("{{.Time}} {{.Action}} {{.IP}} by {{.Actor}} (expiration time {{.ExpirationTime}}): \"{{.Description}}\"\n"))
+
+var bucketTemplate = template.Must(template.New("buckets").Parse("{{.Name}}\n"))
+
+var allowTemplate = template.Must(template.New("allow").Parse("{{.IP}}{{if .Description}} \"{{.Description}}\"{{end}}\n"))
+
+// IPs read by add are written in batches of batchSize, or after batchInterval
+// (so that a slow pipe still gets its records written)
+const (
+	batchSize     = 1000
+	batchInterval = time.Second
+)
+
+// newPrinter returns a printer for the output format requested on the command
+// line, or the given default one; text is the template used by the text format.
+func (e *env) newPrinter(defaultFormat string, text *template.Template) (*printer, error) {
+	format := e.format
+	if len(format) == 0 {
+		format = defaultFormat
+	}
+	return newPrinter(os.Stdout, format, text)
+}
+
+// printRecords prints the records with the output format requested on the
+// command line, or the given default one.
+func (e *env) printRecords(records []gblist.Record, defaultFormat string, text *template.Template) int {
+	p, err := e.newPrinter(defaultFormat, text)
+	for _, record := range records {
+		if err == nil {
+			err = p.print(newRecordView(record))
+		}
+	}
+	if err == nil {
+		err = p.close()
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// newFlagSet returns the flag set for parsing the arguments of a command.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [global flags] %s\n", os.Args[0], commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the arguments of a command; on failure it returns false
+// and the command should exit with exitError.
+func parseArgs(fs *flag.FlagSet, args []string) bool {
+	err := fs.Parse(args)
+	return err == nil
+}
+
+// ttlFlags defines the flags for the banning time, returning a function
+// that sums them up into a duration (14 days if none is given).
+func ttlFlags(fs *flag.FlagSet) func() time.Duration {
+	days := fs.Int("days", 0, "number of days of banning time (they all sum up)")
+	hours := fs.Int("hours", 0, "number of hours of banning time (they all sum up)")
+	minutes := fs.Int("minutes", 0, "number of minutes of banning time (they all sum up)")
+	return func() time.Duration {
+		if *days == 0 && *hours == 0 && *minutes == 0 {
+			return 14 * 24 * time.Hour // 14 days
+		}
+		return time.Duration((*days*24+*hours)*60+*minutes) * time.Minute
+	}
+}
+
+// listFlag is a flag that can be repeated, collecting its values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// metaFlag is a key=value flag that can be repeated
+type metaFlag map[string]string
+
+func (m metaFlag) String() string {
+	return formatCounts(map[string]string(m))
+}
+
+func (m metaFlag) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || len(strings.TrimSpace(pair[0])) == 0 {
+		return errors.New("metadata must be given as key=value")
+	}
+	m[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	return nil
+}
+
+// filterFlags defines the flags for selecting records, returning a function
+// that builds the filter from them.
+func filterFlags(fs *flag.FlagSet) func() (gblist.Filter, error) {
+	country := fs.String("country", "", "only the records from the country with the given ISO code")
+	asn := fs.Uint("asn", 0, "only the records from the given autonomous system number")
+	var tags listFlag
+	fs.Var(&tags, "tag", "only the records with the given tag (can be repeated)")
+	description := fs.String("description", "", "only the records whose description matches the regular expression")
+	network := fs.String("network", "", "only the records within the given CIDR")
+	after := fs.String("expires-after", "", "only the records expiring after the given time (RFC3339, or duration from now)")
+	before := fs.String("expires-before", "", "only the records expiring before the given time (RFC3339, or duration from now)")
+	source := fs.String("source", "", "only the records with the given source")
+	rule := fs.String("rule", "", "only the records created by the given rule")
+	return func() (gblist.Filter, error) {
+		var err error
+		filter := gblist.Filter{
+			Country: strings.ToUpper(strings.TrimSpace(*country)),
+			ASN:     *asn,
+			Tags:    tags,
+			Source:  *source,
+			Rule:    *rule,
+		}
+		if len(*description) > 0 {
+			filter.Description, err = regexp.Compile(*description)
+		}
+		if err == nil && len(*network) > 0 {
+			_, filter.Network, err = net.ParseCIDR(*network)
+		}
+		if err == nil && len(*after) > 0 {
+			filter.ExpiresAfter, err = parseTime(*after)
+		}
+		if err == nil && len(*before) > 0 {
+			filter.ExpiresBefore, err = parseTime(*before)
+		}
+		return filter, err
+	}
+}
+
+// parseTime parses a time in RFC3339 format, or a duration from now
+func parseTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(value)
+		if durationErr == nil {
+			return time.Now().Add(duration), nil
+		}
+	}
+	return t, err
+}
+
+// eachLine calls the function for every non empty, trimmed line of the reader.
+func eachLine(r io.Reader, fn func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 {
+			fn(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// eachIP calls the function for every IP given as argument or, if there are
+// none, for every line read from stdin.
+func eachIP(args []string, fn func(ip string)) error {
+	if len(args) == 0 {
+		return eachLine(os.Stdin, fn)
+	}
+	for _, ip := range args {
+		ip = strings.TrimSpace(ip)
+		if len(ip) > 0 {
+			fn(ip)
+		}
+	}
+	return nil
+}
+
+// add adds the given IPs to the bucket
+func add(e *env, args []string) int {
+	fs := newFlagSet("add")
+	ttl := ttlFlags(fs)
+	description := fs.String("description", "", "add the given text as description for the record")
+	source := fs.String("source", "manual", "what is adding the records")
+	var tags listFlag
+	fs.Var(&tags, "tag", "tag for the records (can be repeated)")
+	meta := make(metaFlag)
+	fs.Var(meta, "meta", "key=value metadata for the records (can be repeated)")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	e.storage.TTL = ttl()
+	status := exitOK
+	writer := e.storage.NewBatchWriter(e.bucket, batchSize, batchInterval)
+	err := eachIP(fs.Args(), func(ip string) {
+		record, err := gblist.New(ip, e.storage.TTL, *description)
+		if err == nil {
+			record.Source = *source
+			record.AddTags(tags...)
+			for k, v := range meta {
+				record.SetMeta(k, v)
+			}
+			if e.enricher != nil {
+				err = e.enricher.Enrich(&record)
+			}
+		}
+		if err == nil {
+			err = writer.Add(record)
+		}
+		if err != nil {
+			printWriteError(err)
+			status = exitError
+		}
+	})
+	if err != nil {
+		printError(err, false)
+		status = exitError
+	}
+	err = writer.Close()
+	if err != nil {
+		printWriteError(err)
+		status = exitError
+	}
+	return status
+}
+
+// printWriteError prints an error of a batch writer, with a line for every
+// IP that was skipped because in the allowlist.
+func printWriteError(err error) {
+	if allowlisted, ok := err.(*gblist.AllowlistError); ok {
+		for _, ip := range allowlisted.IPs {
+			printError(&gblist.AllowlistError{IPs: []string{ip}}, false)
+		}
+		return
+	}
+	printError(err, false)
+}
+
+// remove removes the given IPs, or the ones selected by the filter, from the bucket
+func remove(e *env, args []string) int {
+	fs := newFlagSet("rm")
+	filter := filterFlags(fs)
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	selection, err := filter()
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	if !selection.IsEmpty() {
+		if fs.NArg() > 0 {
+			printError("IPs cannot be given together with a filter", false)
+			return exitError
+		}
+		_, err = e.storage.PurgeSelected(e.bucket, selection)
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+		return exitOK
+	}
+	var addresses []string
+	err = eachIP(fs.Args(), func(ip string) {
+		addresses = append(addresses, ip)
+	})
+	if err == nil {
+		err = e.storage.Purge(e.bucket, addresses...)
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// query prints the records of the given IPs; the exit status tells if
+// all of them are listed. Nothing is listed in a bucket that does not exist.
+func query(e *env, args []string) int {
+	fs := newFlagSet("query")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	p, err := e.newPrinter(formatText, recordTemplate)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	exists, err := e.bucketExists()
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	status := exitOK
+	err = eachIP(fs.Args(), func(ip string) {
+		if status == exitError {
+			return
+		}
+		if !exists {
+			status = exitNotListed
+			return
+		}
+		record, err := e.storage.Fetch(e.bucket, ip)
+		if err == nil && record.IsValid() {
+			err = p.print(newRecordView(record))
+		} else if err == nil {
+			status = exitNotListed
+		}
+		if err != nil {
+			printError(err, false)
+			status = exitError
+		}
+	})
+	if err == nil {
+		err = p.close()
+	}
+	if err != nil {
+		printError(err, false)
+		status = exitError
+	}
+	return status
+}
+
+// bucketExists tells if the bucket of the command line is in the database
+func (e *env) bucketExists() (bool, error) {
+	names, err := e.storage.Buckets()
+	for _, name := range names {
+		if name == e.bucket {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// list prints the non expired IPs in the bucket
+func list(e *env, args []string) int {
+	fs := newFlagSet("list")
+	filter := filterFlags(fs)
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	selection, err := filter()
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	records, err := e.storage.List(e.bucket)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return e.printRecords(selection.Apply(records), formatText, ipTemplate)
+}
+
+// dump prints all the records in the bucket
+func dump(e *env, args []string) int {
+	fs := newFlagSet("dump")
+	filter := filterFlags(fs)
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	selection, err := filter()
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	records, err := e.storage.Dump(e.bucket)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return e.printRecords(selection.Apply(records), formatText, recordTemplate)
+}
+
+// importFiles imports the lists in the given files (or stdin) and reports
+// the outcome for each of them
+func importFiles(e *env, args []string) int {
+	fs := newFlagSet("import")
+	ttl := ttlFlags(fs)
+	description := fs.String("description", "", "description for the records without one")
+	format := fs.String("type", gblist.FormatPlain, "format of the lists: plain, spamhaus, netset, dshield, csv or json")
+	comma := fs.String("comma", ",", "field separator for the csv format")
+	ipColumn := fs.Int("ip-column", 1, "column of the IP for the csv format")
+	descriptionColumn := fs.Int("description-column", 0, "column of the description for the csv format (0 for none)")
+	header := fs.Bool("header", false, "skip the first line for the csv format")
+	var tags listFlag
+	fs.Var(&tags, "tag", "tag for the records (can be repeated)")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	importer := gblist.Importer{
+		Format:            *format,
+		TTL:               ttl(),
+		Description:       *description,
+		Tags:              tags,
+		Enricher:          e.enricher,
+		IPColumn:          *ipColumn,
+		DescriptionColumn: *descriptionColumn,
+		Header:            *header,
+	}
+	if len(*comma) > 0 {
+		importer.Comma = []rune(*comma)[0]
+	}
+	p, err := e.newPrinter(formatText, importTemplate)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := exitOK
+	for _, path := range files {
+		var result gblist.ImportResult
+		importer.Source = path
+		if path == "-" {
+			importer.Source = "stdin"
+			result, err = importer.Import(e.storage, e.bucket, os.Stdin)
+		} else {
+			var file *os.File
+			file, err = os.Open(path)
+			if err == nil {
+				result, err = importer.Import(e.storage, e.bucket, file)
+				file.Close()
+			}
+		}
+		if err == nil {
+			err = p.print(newImportView(path, result))
+		}
+		if err != nil {
+			printError(fmt.Sprintf("%s: %s", path, err.Error()), false)
+			status = exitError
+		}
+	}
+	err = p.close()
+	if err != nil {
+		printError(err, false)
+		status = exitError
+	}
+	return status
+}
+
+// export prints the non expired records of the bucket (as JSON, unless
+// another format is requested)
+func export(e *env, args []string) int {
+	fs := newFlagSet("export")
+	filter := filterFlags(fs)
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	selection, err := filter()
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	records, err := e.storage.List(e.bucket)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return e.printRecords(selection.Apply(records), formatJSON, recordTemplate)
+}
+
+// history prints the events concerning the given IPs, or all of them
+func history(e *env, args []string) int {
+	fs := newFlagSet("history")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	addresses := fs.Args()
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+	p, err := e.newPrinter(formatText, eventTemplate)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	for _, ip := range addresses {
+		var events []gblist.Event
+		events, err = e.storage.History(e.bucket, ip)
+		for _, event := range events {
+			if err == nil {
+				err = p.print(newEventView(event))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = p.close()
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// stats prints the statistics of the given buckets (or the current one)
+func stats(e *env, args []string) int {
+	fs := newFlagSet("stats")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = []string{e.bucket}
+	}
+	p, err := e.newPrinter(formatText, statsTemplate)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	for _, name := range names {
+		var stats gblist.Stats
+		stats, err = e.storage.Stats(name)
+		if err != nil {
+			break
+		}
+		err = p.print(newStatsView(stats))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = p.close()
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// buckets prints the names of the buckets in the database
+func buckets(e *env, args []string) int {
+	fs := newFlagSet("buckets")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	p, err := e.newPrinter(formatText, bucketTemplate)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	names, err := e.storage.Buckets()
+	for _, name := range names {
+		if err == nil {
+			err = p.print(bucketView{Name: name})
+		}
+	}
+	if err == nil {
+		err = p.close()
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// drop deletes the given buckets
+func drop(e *env, args []string) int {
+	fs := newFlagSet("drop")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError
+	}
+	for _, name := range fs.Args() {
+		err := e.storage.DeleteBucket(name)
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+	}
+	return exitOK
+}
+
+// rename renames a bucket
+func rename(e *env, args []string) int {
+	fs := newFlagSet("rename")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitError
+	}
+	err := e.storage.RenameBucket(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// copyBucket copies the records of a bucket into another
+func copyBucket(e *env, args []string) int {
+	fs := newFlagSet("copy")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitError
+	}
+	err := e.storage.CopyBucket(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// allow manages the allowlist: "add" and "rm" take the IPs (or read them from
+// stdin), "list" prints it
+func allow(e *env, args []string) int {
+	fs := newFlagSet("allow")
+	if len(args) == 0 {
+		fs.Usage()
+		return exitError
+	}
+	switch args[0] {
+	case "add", "rm":
+		description := fs.String("description", "", "why the IPs are allowed (add only)")
+		if !parseArgs(fs, args[1:]) {
+			return exitError
+		}
+		var err error
+		eachErr := eachIP(fs.Args(), func(ip string) {
+			if err != nil {
+				return
+			}
+			if args[0] == "add" {
+				err = e.storage.Allow(ip, *description)
+			} else {
+				err = e.storage.Disallow(ip)
+			}
+		})
+		if err == nil {
+			err = eachErr
+		}
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+	case "list":
+		if !parseArgs(fs, args[1:]) {
+			return exitError
+		}
+		p, err := e.newPrinter(formatText, allowTemplate)
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+		entries, err := e.storage.Allowlist()
+		for _, entry := range entries {
+			if err == nil {
+				err = p.print(newAllowView(entry))
+			}
+		}
+		if err == nil {
+			err = p.close()
+		}
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+	default:
+		printError(fmt.Sprintf("unknown allow command %q", args[0]), false)
+		fs.Usage()
+		return exitError
+	}
+	return exitOK
+}
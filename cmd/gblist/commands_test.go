@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestEnv returns an env with a new database in a temporary directory,
+// removed by the returned function
+func newTestEnv(t *testing.T) (*env, func()) {
+	dir, err := ioutil.TempDir("", "gblist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	e := &env{storage: &storage, bucket: "test", format: formatText}
+	return e, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+	if status := query(e, []string{"192.0.2.1"}); status != exitNotListed {
+		t.Errorf("wrong exit status %d for a missing bucket", status)
+	}
+	err := e.storage.Add(e.bucket, gblist.Record{IP: "192.0.2.1", ExpirationTime: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"192.0.2.1"}, exitOK},
+		{[]string{"192.0.2.2"}, exitNotListed},
+		{[]string{"192.0.2.1", "192.0.2.2"}, exitNotListed},
+		{[]string{"-unknown"}, exitError},
+	}
+	for _, test := range tests {
+		if status := query(e, test.args); status != test.status {
+			t.Errorf("wrong exit status %d for %v (expected %d)", status, test.args, test.status)
+		}
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+	commands := map[string]func(*env, []string) int{
+		"list":   list,
+		"export": export,
+	}
+	for name, command := range commands {
+		if status := command(e, nil); status != exitError {
+			t.Errorf("wrong exit status %d for %s of a missing bucket", status, name)
+		}
+	}
+}
+
+func TestAddAllowed(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+	err := e.storage.Allow("192.0.2.1", "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := add(e, []string{"192.0.2.1", "192.0.2.2"}); status != exitError {
+		t.Errorf("wrong exit status %d for adding an allowed IP", status)
+	}
+	list, err := e.storage.List(e.bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].IP != "192.0.2.2" {
+		t.Errorf("wrong records %+v", list)
+	}
+}
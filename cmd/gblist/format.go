@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Output formats; anything containing "{{" is a user supplied Go template.
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatTSV    = "tsv"
+)
+
+// view is an item printed by the read commands, with stable field names.
+type view interface {
+	columns() []string
+	values() []string
+}
+
+// recordView is how a record is presented; timestamps are RFC3339 and
+// TTL is the remaining time to live in seconds (zero if expired).
+type recordView struct {
+	IP             string            `json:"ip"`
+	ExpirationTime string            `json:"expiration_time"`
+	TTL            int64             `json:"ttl"`
+	Description    string            `json:"description"`
+	Country        string            `json:"country"`
+	ASN            uint              `json:"asn"`
+	Organization   string            `json:"organization"`
+	Source         string            `json:"source"`
+	Rule           string            `json:"rule"`
+	CreatedAt      string            `json:"created_at"`
+	UpdatedAt      string            `json:"updated_at"`
+	Hits           int               `json:"hits"`
+	Tags           []string          `json:"tags"`
+	Meta           map[string]string `json:"meta"`
+}
+
+func newRecordView(record gblist.Record) recordView {
+	ttl := time.Until(record.ExpirationTime)
+	if ttl < 0 {
+		ttl = 0
+	}
+	view := recordView{
+		IP:             record.IP,
+		ExpirationTime: formatTime(record.ExpirationTime),
+		TTL:            int64(ttl / time.Second),
+		Description:    record.Description,
+		Country:        record.Country,
+		ASN:            record.ASN,
+		Organization:   record.Organization,
+		Source:         record.Source,
+		Rule:           record.Rule,
+		CreatedAt:      formatTime(record.CreatedAt),
+		UpdatedAt:      formatTime(record.UpdatedAt),
+		Hits:           record.Hits,
+		Tags:           record.Tags,
+		Meta:           record.Meta,
+	}
+	if view.Tags == nil {
+		view.Tags = []string{}
+	}
+	if view.Meta == nil {
+		view.Meta = map[string]string{}
+	}
+	return view
+}
+
+func (r recordView) columns() []string {
+	return []string{"ip", "expiration_time", "ttl", "description", "country", "asn", "organization", "source", "rule", "created_at", "updated_at", "hits", "tags", "meta"}
+}
+
+func (r recordView) values() []string {
+	return []string{
+		r.IP,
+		r.ExpirationTime,
+		strconv.FormatInt(r.TTL, 10),
+		r.Description,
+		r.Country,
+		formatASN(r.ASN),
+		r.Organization,
+		r.Source,
+		r.Rule,
+		r.CreatedAt,
+		r.UpdatedAt,
+		strconv.Itoa(r.Hits),
+		strings.Join(r.Tags, ","),
+		formatCounts(r.Meta),
+	}
+}
+
+// statsView is how the statistics of a bucket are presented.
+type statsView struct {
+	Bucket             string         `json:"bucket"`
+	Active             int            `json:"active"`
+	Expired            int            `json:"expired"`
+	IPv4               int            `json:"ipv4"`
+	IPv6               int            `json:"ipv6"`
+	CIDR               int            `json:"cidr"`
+	EarliestExpiration string         `json:"earliest_expiration"`
+	LatestExpiration   string         `json:"latest_expiration"`
+	Countries          map[string]int `json:"countries"`
+	ASNs               map[uint]int   `json:"asns"`
+}
+
+func newStatsView(stats gblist.Stats) statsView {
+	return statsView{
+		Bucket:             stats.Bucket,
+		Active:             stats.Active,
+		Expired:            stats.Expired,
+		IPv4:               stats.IPv4,
+		IPv6:               stats.IPv6,
+		CIDR:               stats.CIDR,
+		EarliestExpiration: formatTime(stats.EarliestExpiration),
+		LatestExpiration:   formatTime(stats.LatestExpiration),
+		Countries:          stats.Countries,
+		ASNs:               stats.ASNs,
+	}
+}
+
+func (s statsView) columns() []string {
+	return []string{"bucket", "active", "expired", "ipv4", "ipv6", "cidr", "earliest_expiration", "latest_expiration", "countries", "asns"}
+}
+
+func (s statsView) values() []string {
+	return []string{
+		s.Bucket,
+		strconv.Itoa(s.Active),
+		strconv.Itoa(s.Expired),
+		strconv.Itoa(s.IPv4),
+		strconv.Itoa(s.IPv6),
+		strconv.Itoa(s.CIDR),
+		s.EarliestExpiration,
+		s.LatestExpiration,
+		formatCounts(s.Countries),
+		formatCounts(s.ASNs),
+	}
+}
+
+// eventView is how an event of the history is presented.
+type eventView struct {
+	Time           string `json:"time"`
+	Action         string `json:"action"`
+	Actor          string `json:"actor"`
+	IP             string `json:"ip"`
+	ExpirationTime string `json:"expiration_time"`
+	Description    string `json:"description"`
+}
+
+func newEventView(event gblist.Event) eventView {
+	return eventView{
+		Time:           formatTime(event.Time),
+		Action:         event.Action,
+		Actor:          event.Actor,
+		IP:             event.IP,
+		ExpirationTime: formatTime(event.ExpirationTime),
+		Description:    event.Description,
+	}
+}
+
+func (e eventView) columns() []string {
+	return []string{"time", "action", "actor", "ip", "expiration_time", "description"}
+}
+
+func (e eventView) values() []string {
+	return []string{e.Time, e.Action, e.Actor, e.IP, e.ExpirationTime, e.Description}
+}
+
+// importView is how the outcome of an import is presented.
+type importView struct {
+	Source     string `json:"source"`
+	Accepted   int    `json:"accepted"`
+	Rejected   int    `json:"rejected"`
+	Duplicates int    `json:"duplicates"`
+}
+
+func newImportView(source string, result gblist.ImportResult) importView {
+	return importView{
+		Source:     source,
+		Accepted:   result.Accepted,
+		Rejected:   result.Rejected,
+		Duplicates: result.Duplicates,
+	}
+}
+
+func (i importView) columns() []string {
+	return []string{"source", "accepted", "rejected", "duplicates"}
+}
+
+func (i importView) values() []string {
+	return []string{i.Source, strconv.Itoa(i.Accepted), strconv.Itoa(i.Rejected), strconv.Itoa(i.Duplicates)}
+}
+
+// bucketView is how the name of a bucket is presented.
+type bucketView struct {
+	Name string `json:"name"`
+}
+
+func (b bucketView) columns() []string {
+	return []string{"name"}
+}
+
+func (b bucketView) values() []string {
+	return []string{b.Name}
+}
+
+// allowView is how an entry of the allowlist is presented.
+type allowView struct {
+	IP          string `json:"ip"`
+	Description string `json:"description"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func newAllowView(entry gblist.Allowed) allowView {
+	return allowView{
+		IP:          entry.IP,
+		Description: entry.Description,
+		CreatedAt:   formatTime(entry.CreatedAt),
+	}
+}
+
+func (a allowView) columns() []string {
+	return []string{"ip", "description", "created_at"}
+}
+
+func (a allowView) values() []string {
+	return []string{a.IP, a.Description, a.CreatedAt}
+}
+
+// formatASN returns the autonomous system number, or an empty string if unknown.
+func formatASN(asn uint) string {
+	if asn == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(asn), 10)
+}
+
+// formatCounts returns a map (of counts, or strings) as space separated
+// key=value pairs, sorted by key.
+func formatCounts(counts interface{}) string {
+	var pairs []string
+	switch m := counts.(type) {
+	case map[string]int:
+		for k, v := range m {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", k, v))
+		}
+	case map[uint]int:
+		for k, v := range m {
+			pairs = append(pairs, fmt.Sprintf("%d=%d", k, v))
+		}
+	case map[string]string:
+		for k, v := range m {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// formatTime returns the time in RFC3339 format, or an empty string for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// printer writes views in the requested format.
+type printer struct {
+	format   string
+	template *template.Template
+	out      io.Writer
+	csv      *csv.Writer
+	items    []view
+	started  bool
+}
+
+// newPrinter returns a printer for the given format; text is the template
+// used by the text format, which is specific to every command.
+func newPrinter(out io.Writer, format string, text *template.Template) (*printer, error) {
+	p := &printer{
+		format: format,
+		out:    out,
+	}
+	switch format {
+	case formatText:
+		p.template = text
+	case formatJSON, formatNDJSON:
+	case formatCSV, formatTSV:
+		p.csv = csv.NewWriter(out)
+		if format == formatTSV {
+			p.csv.Comma = '\t'
+		}
+	default:
+		if !strings.Contains(format, "{{") {
+			return nil, errors.New(fmt.Sprintf("unknown output format %q", format))
+		}
+		// A new line is added, as it's hard to type it on the command line
+		if !strings.HasSuffix(format, "\n") {
+			format += "\n"
+		}
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return nil, err
+		}
+		p.template = tmpl
+	}
+	return p, nil
+}
+
+// print writes (or buffers, for JSON) a view.
+func (p *printer) print(v view) error {
+	var err error
+	switch p.format {
+	case formatJSON:
+		p.items = append(p.items, v)
+	case formatNDJSON:
+		err = json.NewEncoder(p.out).Encode(v)
+	case formatCSV, formatTSV:
+		if !p.started {
+			err = p.csv.Write(v.columns())
+		}
+		if err == nil {
+			err = p.csv.Write(v.values())
+		}
+	default:
+		err = p.template.Execute(p.out, v)
+	}
+	p.started = true
+	return err
+}
+
+// close flushes whatever is buffered.
+func (p *printer) close() error {
+	var err error
+	switch p.format {
+	case formatJSON:
+		items := p.items
+		if items == nil {
+			items = []view{}
+		}
+		encoder := json.NewEncoder(p.out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(items)
+	case formatCSV, formatTSV:
+		p.csv.Flush()
+		err = p.csv.Error()
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestPrinter(t *testing.T) {
+	items := []view{
+		allowView{IP: "192.0.2.1", Description: "office", CreatedAt: "2020-01-02T03:04:05Z"},
+		allowView{IP: "192.0.2.2", Description: "a, b\tc \"d\"\nnext line"},
+	}
+	text := template.Must(template.New("text").Parse("{{.IP}} {{.Description}}\n"))
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{formatText, "192.0.2.1 office\n192.0.2.2 a, b\tc \"d\"\nnext line\n"},
+		{formatJSON, `[
+  {
+    "ip": "192.0.2.1",
+    "description": "office",
+    "created_at": "2020-01-02T03:04:05Z"
+  },
+  {
+    "ip": "192.0.2.2",
+    "description": "a, b\tc \"d\"\nnext line",
+    "created_at": ""
+  }
+]
+`},
+		{formatNDJSON, `{"ip":"192.0.2.1","description":"office","created_at":"2020-01-02T03:04:05Z"}
+{"ip":"192.0.2.2","description":"a, b\tc \"d\"\nnext line","created_at":""}
+`},
+		{formatCSV, "ip,description,created_at\n" +
+			"192.0.2.1,office,2020-01-02T03:04:05Z\n" +
+			"192.0.2.2,\"a, b\tc \"\"d\"\"\nnext line\",\n"},
+		{formatTSV, "ip\tdescription\tcreated_at\n" +
+			"192.0.2.1\toffice\t2020-01-02T03:04:05Z\n" +
+			"192.0.2.2\t\"a, b\tc \"\"d\"\"\nnext line\"\t\n"},
+		{"{{.IP}}={{.CreatedAt}}", "192.0.2.1=2020-01-02T03:04:05Z\n192.0.2.2=\n"},
+		{"{{.IP}}\n", "192.0.2.1\n192.0.2.2\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		p, err := newPrinter(&out, test.format, text)
+		if err != nil {
+			t.Errorf("format %q refused: %s", test.format, err)
+			continue
+		}
+		for _, item := range items {
+			if err := p.print(item); err != nil {
+				t.Errorf("format %q failed to print: %s", test.format, err)
+			}
+		}
+		if err := p.close(); err != nil {
+			t.Errorf("format %q failed to close: %s", test.format, err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("format %q printed:\n%s\nexpected:\n%s", test.format, out.String(), test.expected)
+		}
+	}
+}
+
+func TestPrinterEmpty(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{formatJSON, "[]\n"},
+		{formatNDJSON, ""},
+		{formatCSV, ""},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		p, err := newPrinter(&out, test.format, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.close(); err != nil {
+			t.Errorf("format %q failed to close: %s", test.format, err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("format %q printed %q for no items (expected %q)", test.format, out.String(), test.expected)
+		}
+	}
+}
+
+func TestPrinterRefused(t *testing.T) {
+	tests := []struct {
+		format string
+		error  string
+	}{
+		{"xml", `unknown output format "xml"`},
+		{"{{.IP", "unclosed action"},
+	}
+	for _, test := range tests {
+		_, err := newPrinter(&bytes.Buffer{}, test.format, nil)
+		if err == nil {
+			t.Errorf("format %q accepted", test.format)
+		} else if !strings.Contains(err.Error(), test.error) {
+			t.Errorf("wrong error for format %q: %s", test.format, err)
+		}
+	}
+}
@@ -1,139 +1,171 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"github.com/weregoat/gblist"
 	"os"
+	"sort"
 	"strings"
-	"text/template"
 	"time"
 )
 
+// Exit codes, following the grep convention so that scripts can branch on them.
+const (
+	exitOK        = 0 // Success (or the queried IPs are listed)
+	exitNotListed = 1 // The queried IP is not listed
+	exitError     = 2 // Any error, including wrong usage
+)
+
+// defaultTimeout is how long gblist waits, by default, for the database to
+// be closed by the process having it open
+const defaultTimeout = 5 * time.Second
+
+// env is what every command works with.
+type env struct {
+	storage  *gblist.Storage
+	bucket   string
+	format   string
+	enricher *gblist.Enricher
+}
+
+// command is a gblist subcommand.
+type command struct {
+	usage       string
+	description string
+	run         func(e *env, args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	// Initialised here, as the usage of the commands refers back to this map
+	commands = map[string]command{
+		"add":        {"add [-days N] [-hours N] [-minutes N] [-description TEXT] [-source NAME] [-tag TAG...] [-meta KEY=VALUE...] [IP...]", "add (or replace) the given IPs; reads them from stdin if none is given", add},
+		"rm":         {"rm [FILTER | IP...]", "remove the given IPs (read from stdin if none is given), or all the records selected by the filter", remove},
+		"query":      {"query [IP...]", "print the given IPs if listed; exits with 1 if any is not", query},
+		"list":       {"list [FILTER]", "print the non expired IP addresses", list},
+		"dump":       {"dump [FILTER]", "print the records in the bucket", dump},
+		"import":     {"import [-type FORMAT] [-days N] [-hours N] [-minutes N] [-description TEXT] [-tag TAG...] [FILE...]", "import the lists in the given files (or stdin) in a single transaction each", importFiles},
+		"export":     {"export [FILTER]", "print the non expired records in the bucket (JSON by default)", export},
+		"history":    {"history [IP...]", "print the history of the given IPs (or of the whole bucket)", history},
+		"stats":      {"stats [BUCKET...]", "print statistics about the buckets", stats},
+		"buckets":    {"buckets", "print the names of the buckets in the database", buckets},
+		"drop":       {"drop BUCKET...", "delete the given buckets", drop},
+		"rename":     {"rename FROM TO", "rename a bucket", rename},
+		"copy":       {"copy FROM TO", "copy the records of a bucket into another", copyBucket},
+		"allow":      {"allow add [-description TEXT] [IP...] | allow rm [IP...] | allow list", "manage the IPs and networks that are never listed, in any bucket; adding one removes the records overlapping it", allow},
+		"serve":      {"serve [-listen ADDRESS] [-backup-listen ADDRESS]", "serve the Prometheus metrics at /metrics and lookups at /query?ip=IP[&bucket=NAME] and, at the -backup-listen address only, a backup of the database at /backup, keeping the database open until interrupted", serve},
+		"backup":     {"backup FILE", "write a consistent copy of the database to the file (- for stdout)", backup},
+		"restore":    {"restore FILE", "replace the whole content of the database with that of a backup", restore},
+		"export-all": {"export-all [FILE]", "write a portable JSON snapshot of all the buckets, with their history, and of the allowlist to the file (or stdout)", exportAll},
+		"import-all": {"import-all [-replace] [FILE]", "read a JSON snapshot from the file (or stdin), merging it into the database or, with -replace, replacing its content", importAll},
+	}
+}
+
 func main() {
 	var databasePath = flag.String("db", "/tmp/gblist.db", "full path of the database file")
-	var print = flag.Bool("print", false, "print the non expired IP addresses from the database")
-	var days = flag.Int("days", 0, "number of days of banning time (they all sum up)")
-	var hours = flag.Int("hours", 0, "number of hours of banning time (they all sum up)")
-	var minutes = flag.Int("minutes", 0, "number of minutes of banning time (they all sum up)")
 	var bucket = flag.String("bucket", "default", "name of the bucket for storing IP addresses")
-	var dump = flag.Bool("dump", false, "dump the result of the database")
-	var purge = flag.Bool("purge", false, "remove the given IPs from the bucket")
-	var query = flag.Bool("query", false, "query the database for the given IP")
-	var description = flag.String("description", "", "add the given text as description for the record")
+	var format = flag.String("format", "", "output format of the read commands: text, json, ndjson, csv, tsv or a Go template (e.g. '{{.IP}} {{.TTL}}')")
+	var onBan = flag.String("on-ban", "", "command (Go template) run when a record is added or extended")
+	var onUnban = flag.String("on-unban", "", "command (Go template) run when a record is removed or expires")
+	var hookTimeout = flag.Duration("hook-timeout", gblist.DefaultHookTimeout, "timeout of the hook commands")
+	var hookConcurrency = flag.Int("hook-concurrency", gblist.DefaultHookConcurrency, "maximum number of hook commands running at once")
+	var countryDB = flag.String("country-db", "", "MaxMind DB (e.g. GeoLite2-Country.mmdb) for adding the country to new records")
+	var asnDB = flag.String("asn-db", "", "MaxMind DB (e.g. GeoLite2-ASN.mmdb) for adding the autonomous system to new records")
+	var timeout = flag.Duration("timeout", defaultTimeout, "how long to wait for another process (like goat-filter -follow or gblist serve) to close the database; 0 for ever")
+	var dryRun = flag.Bool("dry-run", false, "print (to stderr) the records that would be added, extended or removed, without writing anything (nor running hooks)")
+	flag.Usage = usage
 	flag.Parse()
-	duration := fmt.Sprintf("%dh", 14*24) // 14 days
 
-	if *days != 0 || *hours != 0 || *minutes != 0 {
-		duration = fmt.Sprintf("%dm", (*days*24+*hours)*60+*minutes)
-	}
-	ttl, err := time.ParseDuration(duration)
-	if err != nil {
-		printError(fmt.Sprintf("could not parse duration for banning time because error: %s", err.Error()), true)
-	}
-	s, err := gblist.Open(*databasePath, ttl)
-	if err != nil {
-		printError(err, true)
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitError)
 	}
-	defer s.Close()
-	if !*print && !*dump {
-		// https://golang.org/pkg/flag/#NArg
-		// If there are not args left we expect a pipe
-		if flag.NArg() == 0 {
-			scanner := bufio.NewScanner(os.Stdin)
-			for scanner.Scan() {
-				ip := strings.TrimSpace(scanner.Text())
-				process(s, ip, *description, *bucket, *purge, *query)
-				/*
-					if *query {
-						record, err := s.Fetch(*bucket, ip)
-						if err != nil {
-							log.Fatal(err)
-						}
-						if record.IsValid() {
-							tmpl.Execute(os.Stdout, record)
-						}
-					} else if *purge {
-						err = s.Purge(*bucket, ip)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else {
-						record, err := gblist.New(ip, s.TTL, *description)
-						if err != nil {
-							log.Print(err)
-						}
-						err = s.Add(*bucket, record)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} */
-			}
-		} else { // We process all the IP given (more than one allowed)
-			for _, ip := range flag.Args() {
-				process(s, ip, *description, *bucket, *purge, *query)
-			}
-		}
-	} else {
-		if *print {
-			list, err := s.List(*bucket)
-			if err != nil {
-				printError(err, false)
-			} else {
-				for _, record := range list {
-					fmt.Println(record.IP)
-				}
-			}
-		}
-		if *dump {
-			tmpl := template.Must(template.New("dump").Parse("IP: {{.IP}}\nExpiration time: {{.ExpirationTime}}\nDescription: \"{{.Description}}\"\n\n"))
-			dump, err := s.Dump(*bucket)
-			if err != nil {
-				printError(err, true)
-			} else {
-				for _, record := range dump {
-					tmpl.Execute(os.Stdout, record)
-				}
-			}
-		}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		printError(fmt.Sprintf("unknown command %q", flag.Arg(0)), false)
+		usage()
+		os.Exit(exitError)
 	}
-}
 
-func process(storage gblist.Storage, ip string, description string, bucket string, purge bool, query bool) {
-	if len(ip) == 0 {
-		return
-	}
-	if query {
-		record, err := storage.Fetch(bucket, ip)
-		if err != nil {
-			printError(err, true)
-		}
-		if record.IsValid() {
-			tmpl := template.Must(template.New("dump").Parse("IP: {{.IP}}\nExpiration time: {{.ExpirationTime}}\nDescription: \"{{.Description}}\"\n\n"))
-			tmpl.Execute(os.Stdout, record)
-		}
-	} else if purge {
-		err := storage.Purge(bucket, ip)
+	var enricher *gblist.Enricher
+	if len(*countryDB) > 0 || len(*asnDB) > 0 {
+		var err error
+		enricher, err = gblist.OpenEnricher(*countryDB, *asnDB)
 		if err != nil {
 			printError(err, true)
 		}
-	} else {
-		record, err := gblist.New(ip, storage.TTL, description)
+	}
+
+	s, err := gblist.OpenTimeout(*databasePath, 0, *timeout)
+	if err == gblist.ErrLocked {
+		printError(fmt.Sprintf("%s: %s (waited %s); if that's goat-filter -follow or gblist serve, a backup can be taken from its /backup endpoint, when enabled", *databasePath, err, *timeout), true)
+	}
+	if err != nil {
+		printError(err, true)
+	}
+	s.Actor = "gblist"
+	if user := os.Getenv("USER"); len(user) > 0 {
+		s.Actor = fmt.Sprintf("gblist (%s)", user)
+	}
+	if *dryRun {
+		err = s.DryRun()
 		if err != nil {
+			s.Close()
 			printError(err, true)
 		}
-		err = storage.Add(bucket, record)
+	}
+	e := &env{
+		storage:  &s,
+		bucket:   *bucket,
+		format:   strings.TrimSpace(*format),
+		enricher: enricher,
+	}
+	var hooks *gblist.Hooks
+	if len(*onBan) > 0 || len(*onUnban) > 0 {
+		hooks, err = gblist.NewHooks(*onBan, *onUnban, *hookTimeout, *hookConcurrency)
 		if err != nil {
+			s.Close()
 			printError(err, true)
 		}
+		hooks.Start(&s, "")
+	}
+	status := cmd.run(e, flag.Args()[1:])
+	if *dryRun {
+		// On stderr, not to mix them with the output of the command
+		gblist.WriteChanges(os.Stderr, s.Changes())
+	}
+	s.Close()
+	if hooks != nil {
+		hooks.Wait()
+	}
+	os.Exit(status)
+}
+
+// usage prints the global flags and the available commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [global flags] COMMAND [ARGS]\n\nGlobal flags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nCommands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", commands[name].usage, commands[name].description)
 	}
+	fmt.Fprintln(out, "\nFILTER flags (all optional, combined): -tag TAG (repeatable), -network CIDR, -description REGEXP,")
+	fmt.Fprintln(out, "  -expires-after TIME, -expires-before TIME, -source SOURCE, -rule RULE, -country CODE, -asn N")
+	fmt.Fprintf(out, "\nExit status is %d on success, %d if a queried IP is not listed and %d on error.\n", exitOK, exitNotListed, exitError)
 }
 
-// Error prints an error on StdErr and exits (or not)
+// printError prints an error on StdErr and exits (or not)
 func printError(message interface{}, exit bool) {
 	fmt.Fprintln(os.Stderr, message)
 	if exit {
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 }
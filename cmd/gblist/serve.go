@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/weregoat/gblist"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// defaultListen is the address serve listens at by default
+const defaultListen = "127.0.0.1:9412"
+
+// serve serves the Prometheus metrics of the database at /metrics and
+// lookups at /query?ip=IP[&bucket=NAME] and, only if an address is given for
+// it, a backup of the database at /backup, until SIGINT or SIGTERM.
+func serve(e *env, args []string) int {
+	fs := newFlagSet("serve")
+	listen := fs.String("listen", defaultListen, "address to listen at")
+	backupListen := fs.String("backup-listen", "", "address to serve backups at, without authentication (not served by default)")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() > 0 {
+		printError("serve takes no arguments", false)
+		return exitError
+	}
+	if *backupListen == *listen {
+		printError("-backup-listen must differ from -listen", false)
+		return exitError
+	}
+	e.storage.Metrics = gblist.NewMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", gblist.MetricsHandler(e.storage.WriteMetrics))
+	mux.HandleFunc("/query", e.lookup)
+	handlers := map[string]http.Handler{*listen: mux}
+	if len(*backupListen) > 0 {
+		backupMux := http.NewServeMux()
+		backupMux.Handle("/backup", gblist.BackupHandler(e.storage))
+		handlers[*backupListen] = backupMux
+	}
+	var servers []*http.Server
+	errs := make(chan error, len(handlers))
+	for address, handler := range handlers {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, server := range servers {
+				server.Close()
+			}
+			printError(err, false)
+			return exitError
+		}
+		server := &http.Server{Handler: handler}
+		servers = append(servers, server)
+		go func() {
+			errs <- server.Serve(ln)
+		}()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	status := exitOK
+	select {
+	case err := <-errs:
+		printError(err, false)
+		status = exitError
+	case <-stop:
+	}
+	for _, server := range servers {
+		err := server.Close()
+		if err != nil {
+			printError(err, false)
+			status = exitError
+		}
+	}
+	return status
+}
+
+// lookup writes the record of the IP, as JSON, if listed in the bucket
+// (by default the one of the global flag); 404 if not.
+func (e *env) lookup(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+	if valid, err := gblist.IsValid(ip); !valid {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bucket := e.bucket
+	if name := strings.TrimSpace(r.URL.Query().Get("bucket")); len(name) > 0 {
+		bucket = name
+	}
+	record, err := e.storage.Fetch(bucket, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !record.IsValid() {
+		http.Error(w, ip+" is not listed", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRecordView(record))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// backup writes a copy of the database to the given file ("-" for stdout),
+// through a temporary file renamed once complete.
+func backup(e *env, args []string) int {
+	fs := newFlagSet("backup")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitError
+	}
+	path := fs.Arg(0)
+	if path == "-" {
+		_, err := e.storage.Backup(os.Stdout)
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+		return exitOK
+	}
+	err := writeFile(path, func(w io.Writer) error {
+		_, err := e.storage.Backup(w)
+		return err
+	})
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// restore replaces the content of the database with that of a backup
+func restore(e *env, args []string) int {
+	fs := newFlagSet("restore")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitError
+	}
+	err := e.storage.Restore(fs.Arg(0))
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// exportAll writes a JSON snapshot of the whole database to the given file,
+// or stdout
+func exportAll(e *env, args []string) int {
+	fs := newFlagSet("export-all")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitError
+	}
+	var err error
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		err = e.storage.ExportSnapshot(os.Stdout)
+	} else {
+		err = writeFile(fs.Arg(0), e.storage.ExportSnapshot)
+	}
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	return exitOK
+}
+
+// importAll reads a JSON snapshot from the given file, or stdin
+func importAll(e *env, args []string) int {
+	fs := newFlagSet("import-all")
+	replace := fs.Bool("replace", false, "replace the whole content of the database, history included, instead of merging the snapshot into it")
+	if !parseArgs(fs, args) {
+		return exitError
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitError
+	}
+	var r io.Reader = os.Stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			printError(err, false)
+			return exitError
+		}
+		defer file.Close()
+		r = file
+	}
+	count, err := e.storage.ImportSnapshot(r, *replace)
+	if err != nil {
+		printError(err, false)
+		return exitError
+	}
+	fmt.Printf("%d records imported\n", count)
+	return exitOK
+}
+
+// writeFile writes a file through a temporary one in the same directory,
+// so that it's either complete or not there at all
+func writeFile(path string, write func(w io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
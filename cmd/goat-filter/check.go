@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// sampleIP is the IP of the record the templates are checked with
+const sampleIP = "192.0.2.1"
+
+// checkSettings checks what compiling the configuration does not: that the
+// database is defined, that the IP of every pattern is in a group named ip
+// (rather than just in the first one) and that the templates can be executed.
+func checkSettings(settings *Settings) error {
+	if len(strings.TrimSpace(settings.Config.Database)) == 0 {
+		return errors.New("no database defined")
+	}
+	for _, rule := range settings.Rules {
+		if !rule.JSON && rule.Pattern.SubexpNames()[ipGroup(rule.Pattern)] != "ip" {
+			return errors.New(fmt.Sprintf("regexp %s has no (?P<ip>...) group; the first group would be taken as the IP", rule.Pattern))
+		}
+	}
+	record, err := gblist.New(sampleIP, settings.TTL, "sample log line")
+	if err != nil {
+		return err
+	}
+	if len(settings.Sources) > 0 {
+		record.Source = settings.Sources[0]
+	} else {
+		record.Source = settings.Listeners[0]
+	}
+	record.AddTags(settings.Tags...)
+	if len(settings.Rules) > 0 {
+		record.Rule = settings.Rules[0].String()
+	}
+	if settings.Template != nil {
+		err = settings.Template.Execute(ioutil.Discard, record)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to execute print_template: %s", err.Error()))
+		}
+	}
+	msg := message{Text: record.Description, Content: record.Description, Facility: -1}
+	for _, rule := range settings.Rules {
+		_, err = rule.describe(extraction{IP: sampleIP}, &msg, record.Source)
+		if err != nil {
+			return err
+		}
+	}
+	if settings.Hooks != nil {
+		err = settings.Hooks.Check(record)
+	}
+	return err
+}
+
+// testPatterns prints the lines of the file matched by the rules, with
+// the IPs extracted and whether they are whitelisted, followed by a summary.
+// Whitelisted buckets and the allowlist of the database are not consulted.
+func testPatterns(settings *Settings, path string, out io.Writer) error {
+	file, err := openSource(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	lines, matching, found, whitelisted := 0, 0, 0, 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+		text := scanner.Text()
+		matched := false
+		msg := parseLine(text, settings.Syslog)
+		for n, rule := range settings.Rules {
+			if !rule.matches(&msg) {
+				continue
+			}
+			extractions := rule.extract(&msg)
+			if len(extractions) == 0 {
+				continue
+			}
+			if !matched {
+				fmt.Fprintf(out, "%d: %s\n", lines, text)
+				matching++
+				matched = true
+			}
+			for _, ex := range extractions {
+				found++
+				status := ""
+				if isWhitelisted(ex.Address, settings.WhiteList) {
+					whitelisted++
+					status = " (whitelisted)"
+				}
+				fmt.Fprintf(out, "    rule %d (%s): %s%s\n", n+1, rule, ex.IP, status)
+				if rule.Description != nil || rule.RawLine != rawLineFull {
+					description, err := rule.describe(ex, &msg, sourceName(path))
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "        description: %s\n", description)
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d lines, %d matching, %d IPs extracted, %d whitelisted\n", lines, matching, found, whitelisted)
+	return nil
+}
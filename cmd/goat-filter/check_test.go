@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"valid", Config{Database: "test.db", Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern}}, true},
+		{"no database", Config{Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern}}, false},
+		{"unnamed group", Config{Database: "test.db", Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{`(foo|bar) (?P<addr>\S+)`}}, false},
+		{"json rule", Config{Database: "test.db", Bucket: "test", Listeners: []string{"udp://127.0.0.1:5514"},
+			Rules: []RuleConfig{{Format: "json", IPField: "client.ip"}}}, true},
+		{"backup_listen", Config{Database: "test.db", Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern},
+			BackupListen: "127.0.0.1"}, false},
+		{"print_template", Config{Database: "test.db", Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern},
+			Template: "{{.Missing}}"}, false},
+		{"description_template", Config{Database: "test.db", Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern},
+			DescriptionTemplate: "{{.Missing}}"}, false},
+	}
+	for _, test := range tests {
+		settings, err := compileConfig(&test.cfg, nil)
+		if err == nil {
+			err = checkSettings(&settings)
+		}
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestTestPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.log")
+	lines := []string{
+		"postfix/smtpd[42]: connect from mail.example.org[192.0.2.1]",
+		"postfix/smtpd[42]: lost connection after EHLO from unknown[10.0.0.1]",
+		"postfix/smtpd[42]: lost connection after AUTH from unknown[10.0.0.2]",
+		"postfix/smtpd[42]: lost connection after DATA from unknown[10.0.0.10]",
+	}
+	err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Bucket: "test", Sources: []string{"mail.log"}, Patterns: []string{pattern}, WhiteList: []string{"10.0.0.10"}}
+	settings, err := compileConfig(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = testPatterns(&settings, path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	expected := []string{
+		"rule 1 (" + pattern + "): 10.0.0.1\n",
+		"rule 1 (" + pattern + "): 10.0.0.10 (whitelisted)\n",
+		"4 lines, 2 matching, 2 IPs extracted, 1 whitelisted\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("missing %q in:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "10.0.0.2") {
+		t.Errorf("unmatched line in:\n%s", output)
+	}
+}
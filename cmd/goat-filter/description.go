@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+// What is done with the raw line, in the description of the records
+const (
+	rawLineFull     = "full"
+	rawLineTruncate = "truncate"
+	rawLineHash     = "hash"
+	rawLineOmit     = "omit"
+)
+
+// defaultRawLineLength is the length lines are truncated to, if not configured
+const defaultRawLineLength = 200
+
+// descriptionData is what description templates are executed with
+type descriptionData struct {
+	IP       string
+	Rule     string
+	Source   string
+	Time     time.Time // Of the message if known, otherwise when it was read
+	Line     string    // The raw line, truncated or hashed if so configured
+	Program  string
+	Hostname string
+	// The named groups of the pattern or, for JSON rules, the fields of the
+	// conditions and those listed, by path
+	Groups map[string]string
+}
+
+// compileDescription compiles how the rule describes the records
+func compileDescription(rule *Rule, cfg RuleConfig) error {
+	rule.RawLine = strings.ToLower(strings.TrimSpace(cfg.RawLine))
+	switch rule.RawLine {
+	case "":
+		rule.RawLine = rawLineFull
+	case rawLineFull, rawLineTruncate, rawLineHash, rawLineOmit:
+	default:
+		return errors.New(fmt.Sprintf("%s: raw_line must be full, truncate, hash or omit, not %s", ruleLabel(rule.Name), cfg.RawLine))
+	}
+	rule.RawLineLength = cfg.RawLineLength
+	if rule.RawLineLength < 0 {
+		return errors.New(fmt.Sprintf("%s: invalid raw_line_length %d", ruleLabel(rule.Name), cfg.RawLineLength))
+	}
+	if rule.RawLineLength == 0 {
+		rule.RawLineLength = defaultRawLineLength
+	}
+	if len(cfg.DescriptionTemplate) > 0 {
+		tmpl, err := template.New("description").Option("missingkey=zero").Parse(cfg.DescriptionTemplate)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: failed to parse description_template: %s", ruleLabel(rule.Name), err.Error()))
+		}
+		rule.Description = tmpl
+	}
+	return nil
+}
+
+// usesFields returns if the template refers to any of the given fields of
+// its data, or to the data as a whole.
+func usesFields(tmpl *template.Template, fields ...string) bool {
+	if tmpl == nil {
+		return false
+	}
+	used := false
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					walk(child)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.FieldNode:
+			used = used || contains(fields, n.Ident[0])
+		case *parse.VariableNode:
+			used = used || (len(n.Ident) > 1 && n.Ident[0] == "$" && contains(fields, n.Ident[1]))
+		case *parse.DotNode:
+			used = true
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	return used
+}
+
+// rawLine returns the line as configured for the descriptions
+func (r *Rule) rawLine(line string) string {
+	switch r.RawLine {
+	case rawLineTruncate:
+		if utf8.RuneCountInString(line) <= r.RawLineLength {
+			return line
+		}
+		return string([]rune(line)[:r.RawLineLength]) + "..."
+	case rawLineHash:
+		sum := sha256.Sum256([]byte(line))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	case rawLineOmit:
+		return ""
+	}
+	return line
+}
+
+// describe returns the description of the record of an IP extracted from
+// the message.
+func (r *Rule) describe(ex extraction, msg *message, source string) (string, error) {
+	line := r.rawLine(msg.Text)
+	if r.Description == nil {
+		return line, nil
+	}
+	data := descriptionData{
+		IP:       ex.IP,
+		Rule:     r.String(),
+		Source:   source,
+		Time:     msg.Time,
+		Line:     line,
+		Program:  msg.Program,
+		Hostname: msg.Hostname,
+		Groups:   ex.Fields,
+	}
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+	if data.Groups == nil {
+		data.Groups = make(map[string]string)
+	}
+	var description bytes.Buffer
+	err := r.Description.Execute(&description, data)
+	if err != nil {
+		return line, errors.New(fmt.Sprintf("%s: failed to execute description_template: %s", ruleLabel(r.Name), err.Error()))
+	}
+	return description.String(), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRule_RawLine(t *testing.T) {
+	line := "lost connection after EHLO from unknown[192.0.2.1]"
+	// Nine characters, but more bytes
+	accented := "àèìòù€ñçß"
+	sum := sha256.Sum256([]byte(line))
+	tests := []struct {
+		rawLine  string
+		length   int
+		line     string
+		expected string
+	}{
+		{"", 0, line, line},
+		{"full", 5, line, line},
+		{"truncate", 0, line, line}, // Shorter than the default length
+		{"truncate", 4, line, "lost..."},
+		{"truncate", len(line), line, line},
+		{"truncate", 5, accented, "àèìòù..."},
+		{"truncate", 9, accented, accented},
+		{"hash", 0, line, "sha256:" + hex.EncodeToString(sum[:])},
+		{"Hash", 4, line, "sha256:" + hex.EncodeToString(sum[:])},
+		{"omit", 0, line, ""},
+	}
+	for _, test := range tests {
+		rule, err := compileRule(RuleConfig{Pattern: pattern, RawLine: test.rawLine, RawLineLength: test.length})
+		if err != nil {
+			t.Errorf("%s: %s", test.rawLine, err)
+			continue
+		}
+		if raw := rule.rawLine(test.line); raw != test.expected {
+			t.Errorf("%s %d: wrong line %q (expected %q)", test.rawLine, test.length, raw, test.expected)
+		}
+	}
+	long := strings.Repeat("x", defaultRawLineLength+1)
+	rule, _ := compileRule(RuleConfig{Pattern: pattern, RawLine: "truncate"})
+	if raw := rule.rawLine(long); raw != long[:defaultRawLineLength]+"..." {
+		t.Errorf("not truncated to the default length: %q", raw)
+	}
+	for _, cfg := range []RuleConfig{{Pattern: pattern, RawLine: "cut"}, {Pattern: pattern, RawLine: "truncate", RawLineLength: -1}} {
+		_, err := compileRule(cfg)
+		if err == nil {
+			t.Errorf("invalid raw_line %q (%d) accepted", cfg.RawLine, cfg.RawLineLength)
+		}
+	}
+}
+
+func TestRule_Describe(t *testing.T) {
+	text := "lost connection after EHLO from unknown[192.0.2.1]"
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := message{Text: text, Content: text, Time: stamp, Program: "postfix/smtpd", Hostname: "mx"}
+	tests := []struct {
+		cfg      RuleConfig
+		expected string
+	}{
+		// Without a template, the raw line as configured
+		{RuleConfig{Pattern: pattern}, text},
+		{RuleConfig{Pattern: pattern, RawLine: "omit"}, ""},
+		{RuleConfig{Pattern: `after (?P<command>\S+) from (?P<host>[^[]+)\[(?P<ip>[0-9.]+)\]`, Name: "postfix",
+			DescriptionTemplate: `{{.Rule}} {{.Source}} {{.Hostname}} {{.Program}} {{.Groups.command}} from {{.Groups.host}} {{.IP}} {{.Time.Format "2006-01-02"}}`},
+			"postfix mail.log mx postfix/smtpd EHLO from unknown 192.0.2.1 2020-01-02"},
+		// The line in the template is the one configured, not the original
+		{RuleConfig{Pattern: pattern, RawLine: "truncate", RawLineLength: 4, DescriptionTemplate: "{{.IP}}: {{.Line}}"}, "192.0.2.1: lost..."},
+		// A missing group is empty, not "<no value>"
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "[{{.Groups.missing}}]"}, "[]"},
+	}
+	for _, test := range tests {
+		rule, err := compileRule(test.cfg)
+		if err != nil {
+			t.Errorf("%s: %s", test.cfg.DescriptionTemplate, err)
+			continue
+		}
+		extractions := rule.extract(&msg)
+		if len(extractions) != 1 {
+			t.Errorf("%s: wrong extractions %+v", rule.Pattern, extractions)
+			continue
+		}
+		description, err := rule.describe(extractions[0], &msg, "mail.log")
+		if err != nil {
+			t.Errorf("%s: %s", test.cfg.DescriptionTemplate, err)
+		} else if description != test.expected {
+			t.Errorf("wrong description %q (expected %q)", description, test.expected)
+		}
+	}
+
+	// JSON rules have the fields by path, and those missing are empty
+	rule, err := compileRule(RuleConfig{Format: "json", IPField: "client.ip", Fields: []string{"request.path", "user"},
+		DescriptionTemplate: `{{index .Groups "request.path"}} [{{.Groups.user}}]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = parseSyslog(`{"client": {"ip": "192.0.2.1"}, "request": {"path": "/wp-login.php"}}`)
+	description, err := rule.describe(extraction{IP: "192.0.2.1", Fields: rule.extract(&msg)[0].Fields}, &msg, "stdin")
+	if err != nil || description != "/wp-login.php []" {
+		t.Errorf("wrong description %q (%v)", description, err)
+	}
+
+	// A failing template falls back to the line
+	rule, err = compileRule(RuleConfig{Pattern: pattern, DescriptionTemplate: "{{.Time.Foo}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = message{Text: text}
+	description, err = rule.describe(extraction{IP: "192.0.2.1"}, &msg, "stdin")
+	if err == nil || description != text {
+		t.Errorf("wrong description %q of a failing template (%v)", description, err)
+	}
+}
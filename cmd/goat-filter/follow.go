@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// While following, the sources are checked every followInterval and, if
+// there are hooks, the expired records are purged every purgeInterval
+const (
+	followInterval = time.Second
+	purgeInterval  = time.Minute
+)
+
+// tail reads the lines appended to a file, reopening it when it's rotated
+// and starting over when it's truncated. An incomplete last line is read
+// as it is when the file is rotated or truncated, as nothing will be
+// appended to it any more.
+type tail struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	partial string // Last line, until it's complete
+}
+
+// open opens the file, reading it from the beginning; a missing file is
+// not an error, as it may be created later.
+func (t *tail) open() error {
+	file, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.file = file
+	t.reader = bufio.NewReader(file)
+	t.offset = 0
+	t.partial = ""
+	return nil
+}
+
+// close closes the file, if open
+func (t *tail) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// poll calls fn for every complete line appended since the last call.
+func (t *tail) poll(fn func(line string) error) error {
+	if t.file == nil {
+		err := t.open()
+		if err != nil || t.file == nil {
+			return err
+		}
+	}
+	err := t.readLines(fn)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return nil // Rotated, and not created again yet
+	}
+	opened, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, opened) {
+		// Whatever was written to the old file was read above
+		err = t.flush(fn)
+		t.close()
+		if err != nil {
+			return err
+		}
+		err = t.open()
+		if err == nil && t.file != nil {
+			err = t.readLines(fn)
+		}
+	} else if info.Size() < t.offset {
+		err = t.flush(fn)
+		if err == nil {
+			_, err = t.file.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			t.reader.Reset(t.file)
+			t.offset = 0
+			err = t.readLines(fn)
+		}
+	}
+	return err
+}
+
+// flush calls fn for the incomplete last line, if any
+func (t *tail) flush(fn func(line string) error) error {
+	line := strings.TrimRight(t.partial, "\r\n")
+	t.partial = ""
+	if len(line) == 0 {
+		return nil
+	}
+	return fn(line)
+}
+
+// readLines reads up to the end of the file
+func (t *tail) readLines(fn func(line string) error) error {
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err == io.EOF {
+			t.partial += chunk
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		t.partial = ""
+		err = fn(line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// follow parses the sources, and what is appended to them, until SIGINT or
+// SIGTERM. On SIGHUP the configuration is reloaded; the sources that are
+// still configured are read on from where they were. Compressed files and
+// the older files matched by a glob pattern are read just once. With the
+// standard input as source, it stops when that is closed.
+func (r *runner) follow() error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(hangup)
+	defer signal.Stop(stop)
+	poll := time.NewTicker(followInterval)
+	defer poll.Stop()
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	tails := make(map[string]*tail)
+	defer func() {
+		for _, t := range tails {
+			t.close()
+		}
+	}()
+	var following *Settings // The settings the live files are from
+	var live []string
+	done := make(map[string]bool)
+	streams := make(map[string]bool)
+	errs := make(chan error, 1)
+	closed := make(chan struct{})
+	listeners := make(map[string]*listener)
+	defer func() {
+		for _, l := range listeners {
+			l.close()
+		}
+	}()
+	servers := []struct {
+		address string
+		what    string
+		serve   func(net.Listener, <-chan struct{})
+	}{
+		{r.current().MetricsListen, "metrics", r.serveMetrics},
+		{r.current().BackupListen, "backups", r.serveBackup},
+	}
+	for _, server := range servers {
+		if len(server.address) == 0 {
+			continue
+		}
+		ln, err := net.Listen("tcp", server.address)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to serve %s at %s: %s", server.what, server.address, err.Error()))
+		}
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+			ln.Close()
+		}()
+		go server.serve(ln, done)
+	}
+	for {
+		settings := r.current()
+		if settings != following {
+			err := r.updateListeners(listeners, settings.Listeners)
+			if err != nil {
+				if following == nil {
+					return err
+				}
+				r.logError(err) // The others are still running
+			}
+			var started []string
+			live, started, err = r.liveSources(settings.Sources, done)
+			if err != nil {
+				return err
+			}
+			for _, path := range started {
+				if !streams[path] {
+					streams[path] = true
+					go r.stream(path, errs, closed)
+				}
+			}
+			following = settings
+			for path, t := range tails {
+				if !contains(live, path) {
+					t.close()
+					delete(tails, path)
+				}
+			}
+		}
+		for _, path := range live {
+			t, ok := tails[path]
+			if !ok {
+				t = &tail{path: path}
+				tails[path] = t
+			}
+			source := path
+			err := t.poll(func(line string) error {
+				return r.process(source, line)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case <-poll.C:
+		case <-purge.C:
+			if settings.Hooks != nil {
+				_, err := settings.Storage.List(settings.Bucket)
+				if err != nil {
+					r.logError(errors.New(fmt.Sprintf("failed to purge expired records: %s", err.Error())))
+				}
+			}
+		case <-hangup:
+			r.reload()
+		case err := <-errs:
+			return err
+		case <-closed:
+			log.Printf("standard input closed, stopping")
+			return nil
+		case sig := <-stop:
+			log.Printf("%s received, stopping", sig)
+			return nil
+		}
+	}
+}
+
+// liveSources returns the files to follow, and the streams: for a glob
+// pattern that's the newest file matched, as the others are rotated logs.
+// These, and compressed files, are read once (the sources concurrently,
+// the files of each oldest first), unless they are in done.
+func (r *runner) liveSources(sources []string, done map[string]bool) ([]string, []string, error) {
+	var live []string
+	var streams []string
+	var once [][]string
+	groups, err := expandSources(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, files := range groups {
+		var group []string
+		for i, file := range files {
+			newest := i == len(files)-1
+			if isStream(file) {
+				streams = append(streams, file)
+				continue
+			}
+			if newest && !isCompressed(file) {
+				live = append(live, file)
+				continue
+			}
+			if !done[file] {
+				group = append(group, file)
+			}
+		}
+		if len(group) > 0 {
+			once = append(once, group)
+		}
+	}
+	err = r.readFiles(once, r.current().Workers)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range once {
+		for _, file := range group {
+			done[file] = true
+		}
+	}
+	return live, streams, nil
+}
+
+// updateListeners starts the listeners at the given addresses that are not
+// running yet, and stops the others.
+func (r *runner) updateListeners(listeners map[string]*listener, addresses []string) error {
+	for address, l := range listeners {
+		if !contains(addresses, address) {
+			l.close()
+			delete(listeners, address)
+		}
+	}
+	for _, address := range addresses {
+		if _, ok := listeners[address]; ok {
+			continue
+		}
+		l, err := r.listen(address)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to start listener %s: %s", address, err.Error()))
+		}
+		listeners[address] = l
+	}
+	return nil
+}
+
+// stream reads a stream in the background: a named pipe is opened again
+// (waiting for the next writer) once closed, while closed is closed once
+// the standard input is. Streams are read until goat-filter stops, even if
+// removed from the configuration.
+func (r *runner) stream(path string, errs chan<- error, closed chan<- struct{}) {
+	for {
+		err := r.readFile(path)
+		if err != nil {
+			select {
+			case errs <- err:
+			default: // Another error is already stopping it
+			}
+			return
+		}
+		if isStdin(path) {
+			close(closed)
+			return
+		}
+	}
+}
+
+// reload loads the configuration again and, if valid, swaps it in,
+// logging what changed.
+func (r *runner) reload() {
+	old := r.current()
+	cfg, err := loadConfig(r.configPath)
+	if err == nil && cfg.Database != old.Config.Database {
+		err = errors.New("the database cannot be changed without restarting")
+	}
+	if err == nil && strings.TrimSpace(cfg.Bucket) != old.Bucket {
+		err = errors.New("the bucket cannot be changed without restarting")
+	}
+	if err == nil && strings.TrimSpace(cfg.MetricsListen) != old.MetricsListen {
+		err = errors.New("metrics_listen cannot be changed without restarting")
+	}
+	if err == nil && strings.TrimSpace(cfg.BackupListen) != old.BackupListen {
+		err = errors.New("backup_listen cannot be changed without restarting")
+	}
+	var settings Settings
+	if err == nil {
+		settings, err = compileConfig(&cfg, old.Storage)
+	}
+	if err != nil {
+		r.logError(errors.New(fmt.Sprintf("configuration %s not reloaded: %s", r.configPath, err.Error())))
+		return
+	}
+	r.swap(&settings)
+	changes := diffConfig(&old.Config, &cfg)
+	if len(settings.WhiteList) != len(old.WhiteList) {
+		changes = append(changes, fmt.Sprintf("whitelist: %d networks (was %d)", len(settings.WhiteList), len(old.WhiteList)))
+	}
+	if len(changes) == 0 {
+		log.Printf("configuration %s reloaded: nothing changed", r.configPath)
+	}
+	for _, change := range changes {
+		log.Printf("configuration %s reloaded: %s", r.configPath, change)
+	}
+}
+
+// diffConfig describes the differences between two configurations
+func diffConfig(old *Config, new *Config) []string {
+	var changes []string
+	changes = append(changes, diffList("source", old.Sources, new.Sources)...)
+	changes = append(changes, diffList("pattern", old.Patterns, new.Patterns)...)
+	changes = append(changes, diffList("rule", ruleStrings(old.Rules), ruleStrings(new.Rules))...)
+	changes = append(changes, diffList("listener", old.Listeners, new.Listeners)...)
+	changes = append(changes, diffList("whitelist entry", old.WhiteList, new.WhiteList)...)
+	changes = append(changes, diffList("tag", old.Tags, new.Tags)...)
+	values := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"ttl", old.TTL, new.TTL},
+		{"print_template", old.Template, new.Template},
+		{"on_ban", old.OnBan, new.OnBan},
+		{"on_unban", old.OnUnban, new.OnUnban},
+		{"hook_timeout", old.HookTimeout, new.HookTimeout},
+		{"hook_concurrency", old.HookConcurrency, new.HookConcurrency},
+		{"geoip_country_db", old.CountryDB, new.CountryDB},
+		{"geoip_asn_db", old.ASNDB, new.ASNDB},
+		{"description_template", old.DescriptionTemplate, new.DescriptionTemplate},
+		{"raw_line", old.RawLine, new.RawLine},
+		{"raw_line_length", old.RawLineLength, new.RawLineLength},
+		{"workers", old.Workers, new.Workers},
+	}
+	for _, value := range values {
+		if value.old != value.new {
+			changes = append(changes, fmt.Sprintf("%s: %q (was %q)", value.name, fmt.Sprint(value.new), fmt.Sprint(value.old)))
+		}
+	}
+	return changes
+}
+
+// ruleStrings returns the rules as strings, for comparing them
+func ruleStrings(rules []RuleConfig) []string {
+	var list []string
+	for _, rule := range rules {
+		list = append(list, fmt.Sprintf("%+v", rule))
+	}
+	return list
+}
+
+// diffList describes the elements added to and removed from a list
+func diffList(name string, old []string, new []string) []string {
+	var changes []string
+	for _, element := range new {
+		if !contains(old, element) {
+			changes = append(changes, fmt.Sprintf("%s added: %q", name, element))
+		}
+	}
+	for _, element := range old {
+		if !contains(new, element) {
+			changes = append(changes, fmt.Sprintf("%s removed: %q", name, element))
+		}
+	}
+	return changes
+}
+
+// contains returns if the list contains the element
+func contains(list []string, element string) bool {
+	for _, e := range list {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTail_Poll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.log")
+	appendFile := func(text string) {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteString(text)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tl := &tail{path: path}
+	defer tl.close()
+	steps := []struct {
+		name   string
+		change func()
+		lines  []string
+	}{
+		{"missing file", func() {}, nil},
+		{"created", func() { appendFile("one\ntw") }, []string{"one"}},
+		{"line completed", func() { appendFile("o\r\nthr") }, []string{"two"}},
+		{"rotated", func() {
+			err := os.Rename(path, path+".1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendFile("four\n")
+		}, []string{"thr", "four"}},
+		{"appended", func() { appendFile("five\nsix\nsev") }, []string{"five", "six"}},
+		{"truncated", func() {
+			err := ioutil.WriteFile(path, []byte("eight\n"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"sev", "eight"}},
+		{"removed", func() {
+			err := os.Remove(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+	}
+	for _, step := range steps {
+		step.change()
+		var lines []string
+		err = tl.poll(func(line string) error {
+			lines = append(lines, line)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", step.name, err)
+		}
+		if !reflect.DeepEqual(lines, step.lines) {
+			t.Errorf("%s: wrong lines %q (expected %q)", step.name, lines, step.lines)
+		}
+	}
+}
+
+func TestRunner_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goat-filter.yaml")
+	config := "database: " + filepath.Join(dir, "test.db") + "\nbucket: test\nsources:\n  - mail.log\npatterns:\n  - '" + pattern + "'\n"
+	writeConfig := func(extra string) {
+		err := ioutil.WriteFile(path, []byte(config+extra), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer settings.Storage.Close()
+	r := newRunner(path, &settings)
+	defer r.writer.Close()
+
+	refused := []struct {
+		name   string
+		config string
+	}{
+		{"invalid pattern", config + "  - '(?P<ip>'\n"},
+		{"other bucket", strings.Replace(config, "bucket: test", "bucket: other", 1)},
+		{"metrics_listen", config + "metrics_listen: 127.0.0.1:9413\n"},
+		{"backup_listen", config + "backup_listen: 127.0.0.1:9414\n"},
+		{"negative workers", config + "workers: -1\n"},
+	}
+	for _, test := range refused {
+		err = ioutil.WriteFile(path, []byte(test.config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.reload()
+		if r.current() != &settings {
+			t.Errorf("configuration with %s reloaded", test.name)
+		}
+	}
+
+	writeConfig("tags:\n  - mail\n")
+	r.reload()
+	if r.current() == &settings {
+		t.Fatalf("valid configuration not reloaded")
+	}
+	if tags := r.current().Config.Tags; len(tags) != 1 || tags[0] != "mail" {
+		t.Errorf("wrong tags after reloading %v", tags)
+	}
+	changes := diffConfig(&settings.Config, &r.current().Config)
+	if !reflect.DeepEqual(changes, []string{`tag added: "mail"`}) {
+		t.Errorf("wrong changes %q", changes)
+	}
+}
+
+func TestRunner_ReloadHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goat-filter.yaml")
+	banned := filepath.Join(dir, "banned")
+	config := "database: " + filepath.Join(dir, "test.db") + "\nbucket: test\nsources:\n  - mail.log\npatterns:\n  - '" + pattern + "'\n"
+	writeConfig := func(n int) {
+		hook := fmt.Sprintf("on_ban: 'sleep 0.1; echo %d {{.IP}} >> %s'\n", n, banned)
+		err := ioutil.WriteFile(path, []byte(config+hook), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(0)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner(path, &settings)
+	defer r.writer.Close()
+
+	for n := 0; n < 3; n++ {
+		if n > 0 {
+			writeConfig(n)
+			r.reload()
+		}
+		ip := fmt.Sprintf("192.0.2.%d", n+1)
+		err = settings.Storage.Add("test", gblist.Record{IP: ip, ExpirationTime: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Wait for the dispatcher, so that it sees every configuration
+		for deadline := time.Now().Add(time.Second); r.stats.summary(nil).Added <= int64(n) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	settings.Storage.Close()
+	r.wait()
+	if r.hooks != r.current().Hooks {
+		t.Errorf("the hooks of the current configuration are not the last ones run")
+	}
+	content, err := ioutil.ReadFile(banned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	sort.Strings(lines)
+	expected := []string{"0 192.0.2.1", "1 192.0.2.2", "2 192.0.2.3"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("wrong hooks run %q", lines)
+	}
+}
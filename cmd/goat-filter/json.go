@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// operators are the operators of the conditions, the longer first for
+// parsing them
+var operators = []string{"==", "!=", "<=", ">=", "=~", "!~", "<", ">"}
+
+// condition is a condition on a field of a JSON message, like
+// "status >= 400" or "request.uri =~ ^/wp-"
+type condition struct {
+	field    string
+	path     []string
+	operator string
+	value    string
+	number   float64
+	isNumber bool
+	re       *regexp.Regexp
+}
+
+// parseCondition parses a condition: a field path, an operator and a value,
+// optionally quoted. Numbers are compared as numbers, when the field is one
+// (or a string holding one); =~ and !~ match a regular expression.
+func parseCondition(text string) (*condition, error) {
+	i := strings.IndexAny(text, "=!<>")
+	if i <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid condition %s: it must be like FIELD OPERATOR VALUE", text))
+	}
+	c := &condition{field: strings.TrimSpace(text[:i])}
+	for _, operator := range operators {
+		if strings.HasPrefix(text[i:], operator) {
+			c.operator = operator
+			break
+		}
+	}
+	if len(c.operator) == 0 || len(c.field) == 0 {
+		return nil, errors.New(fmt.Sprintf("invalid condition %s: it must be like FIELD OPERATOR VALUE", text))
+	}
+	c.path = splitPath(c.field)
+	c.value = strings.TrimSpace(text[i+len(c.operator):])
+	if len(c.value) > 1 && (c.value[0] == '"' || c.value[0] == '\'') && c.value[len(c.value)-1] == c.value[0] {
+		c.value = c.value[1 : len(c.value)-1]
+	}
+	var err error
+	switch c.operator {
+	case "=~", "!~":
+		c.re, err = regexp.Compile(c.value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid condition %s: %s", text, err.Error()))
+		}
+	case "<", "<=", ">", ">=":
+		c.number, err = strconv.ParseFloat(c.value, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid condition %s: %s is not a number", text, c.value))
+		}
+		c.isNumber = true
+	default:
+		c.number, err = strconv.ParseFloat(c.value, 64)
+		c.isNumber = err == nil
+	}
+	return c, nil
+}
+
+// matches returns if the document satisfies the condition; a missing field
+// satisfies none.
+func (c *condition) matches(document interface{}) bool {
+	value, ok := lookup(document, c.path)
+	if !ok {
+		return false
+	}
+	text := fieldString(value)
+	if c.re != nil {
+		return c.re.MatchString(text) == (c.operator == "=~")
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if c.isNumber && err == nil {
+		switch c.operator {
+		case "==":
+			return number == c.number
+		case "!=":
+			return number != c.number
+		case "<":
+			return number < c.number
+		case "<=":
+			return number <= c.number
+		case ">":
+			return number > c.number
+		case ">=":
+			return number >= c.number
+		}
+	}
+	switch c.operator {
+	case "==":
+		return text == c.value
+	case "!=":
+		return text != c.value
+	}
+	return false // Not a number
+}
+
+// splitPath splits the path of a field, like request.headers.X-Forwarded-For.0
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimSpace(path), ".")
+}
+
+// decodeJSON decodes a JSON object, keeping the numbers as they are written
+func decodeJSON(text string) (interface{}, error) {
+	var document map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	return document, err
+}
+
+// lookup returns the value at the path of the document: the elements of the
+// path are the keys of the objects, or the indexes of the arrays. Null is
+// the same as missing.
+func lookup(document interface{}, path []string) (interface{}, bool) {
+	value := document
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+		if value == nil {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// fieldString returns a value as a string; objects and arrays as JSON
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// jsonIP returns the IP (or CIDR) in a value, with its address: the value
+// can be an IP, an IP with a port, a list of them separated by commas (like
+// X-Forwarded-For) or an array of them. Of a list only the element at the
+// given index is taken, counting from 1, or from the end if negative (-1
+// is the last one): the others, being written by the client or by the
+// proxies, are never banned. Nothing is returned if that is not an IP.
+func jsonIP(value interface{}, index int) (string, net.IP) {
+	var values []string
+	switch v := value.(type) {
+	case string:
+		values = strings.Split(v, ",")
+	case []interface{}:
+		for _, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				s = "" // Still an element, for counting
+			}
+			values = append(values, strings.Split(s, ",")...)
+		}
+	}
+	if index < 0 {
+		index += len(values)
+	} else {
+		index--
+	}
+	if index < 0 || index >= len(values) {
+		return "", nil
+	}
+	ip := strings.TrimSpace(values[index])
+	address := parseAddress(ip)
+	if address == nil {
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+			address = parseAddress(ip)
+		}
+	}
+	if address == nil {
+		return "", nil
+	}
+	return ip, address
+}
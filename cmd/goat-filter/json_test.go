@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJSONIP(t *testing.T) {
+	forwarded := "203.0.113.7, 198.51.100.1, 192.0.2.1"
+	array := []interface{}{"203.0.113.7", "198.51.100.1:443", "[2001:db8::1]:443"}
+	tests := []struct {
+		value    interface{}
+		index    int
+		expected string
+	}{
+		{"192.0.2.1", -1, "192.0.2.1"},
+		{"192.0.2.1", 1, "192.0.2.1"},
+		{"192.0.2.1:8080", -1, "192.0.2.1"},
+		{"192.0.2.0/24", -1, "192.0.2.0/24"},
+		{forwarded, -1, "192.0.2.1"},
+		{forwarded, -2, "198.51.100.1"},
+		{forwarded, 1, "203.0.113.7"},
+		{forwarded, -4, ""},
+		{forwarded, 4, ""},
+		{array, -1, "2001:db8::1"},
+		{array, -2, "198.51.100.1"},
+		{[]interface{}{"192.0.2.1", 42.0}, -1, ""}, // Not a string, not taken from the others
+		{"unknown, 192.0.2.1", 1, ""},
+		{"", -1, ""},
+		{42.0, -1, ""},
+	}
+	for _, test := range tests {
+		ip, address := jsonIP(test.value, test.index)
+		if ip != test.expected || (address == nil) != (len(test.expected) == 0) {
+			t.Errorf("wrong IP %q (%s) from %v at %d (expected %q)", ip, address, test.value, test.index, test.expected)
+		}
+	}
+}
+
+func TestRule_Extract_JSON(t *testing.T) {
+	rule, err := compileRule(RuleConfig{Format: "json", IPField: "headers.x-forwarded-for", Conditions: []string{"status >= 400"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client put an address in the header, the proxy appended the real one
+	msg := parseSyslog(`{"status": 404, "headers": {"x-forwarded-for": "10.0.0.1, 203.0.113.7"}}`)
+	extractions := rule.extract(&msg)
+	if len(extractions) != 1 || extractions[0].IP != "203.0.113.7" || extractions[0].Fields["status"] != "404" {
+		t.Errorf("wrong extractions %+v", extractions)
+	}
+	msg = parseSyslog(`{"status": 200, "headers": {"x-forwarded-for": "203.0.113.7"}}`)
+	if extractions = rule.extract(&msg); len(extractions) != 0 {
+		t.Errorf("extracted from a message not satisfying the conditions: %+v", extractions)
+	}
+	_, err = compileRule(RuleConfig{Pattern: pattern, IPIndex: 1})
+	if err == nil {
+		t.Errorf("ip_index accepted in a text rule")
+	}
+}
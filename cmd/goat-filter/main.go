@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,115 +11,178 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 )
 
+// Records are written in batches of batchSize, or after batchInterval
+const (
+	batchSize     = 1000
+	batchInterval = 5 * time.Second
+)
+
 // Config is the definition of the YAML configuration elements
 type Config struct {
-	Sources   []string `yaml:"sources"`
-	Patterns  []string `yaml:"patterns"`
-	Database  string   `yaml:"database"`
-	Bucket    string   `yaml:"bucket"`
-	TTL       string   `yaml:"ttl"`
-	WhiteList []string `yaml:"network_whitelist"`
-	Template  string   `yaml:"print_template"`
+	Sources  []string `yaml:"sources"`
+	Patterns []string `yaml:"patterns"`
+	// Rules are patterns with conditions; the patterns above are rules without any
+	Rules []RuleConfig `yaml:"rules"`
+	// Syslog listeners, like udp://0.0.0.0:514 (only with -follow)
+	Listeners []string `yaml:"listeners"`
+	// Address serving the Prometheus metrics at /metrics (only with -follow)
+	MetricsListen string `yaml:"metrics_listen"`
+	// Address serving a backup of the database at /backup, without any
+	// authentication (only with -follow)
+	BackupListen string   `yaml:"backup_listen"`
+	Database     string   `yaml:"database"`
+	Bucket       string   `yaml:"bucket"`
+	TTL          string   `yaml:"ttl"`
+	WhiteList    []string `yaml:"network_whitelist"`
+	Template     string   `yaml:"print_template"`
+	// Commands run when a record is added or extended, and when it's removed or expired
+	OnBan           string `yaml:"on_ban"`
+	OnUnban         string `yaml:"on_unban"`
+	HookTimeout     string `yaml:"hook_timeout"`
+	HookConcurrency int    `yaml:"hook_concurrency"`
+	// MaxMind DB files for adding country and autonomous system to the records
+	CountryDB string `yaml:"geoip_country_db"`
+	ASNDB     string `yaml:"geoip_asn_db"`
+	// Tags added to every record
+	Tags []string `yaml:"tags"`
+	// Defaults of the rules (and the only way to set them for the patterns)
+	DescriptionTemplate string `yaml:"description_template"`
+	RawLine             string `yaml:"raw_line"`
+	RawLineLength       int    `yaml:"raw_line_length"`
+	// How many sources are read at once (by default, as many as the CPUs);
+	// the files matched by a pattern are read one after the other
+	Workers int `yaml:"workers"`
 }
 
 // Settings are the settings from the configuration after parsing
 type Settings struct {
+	Config    Config // As loaded, for telling what changed on reload
 	Storage   *gblist.Storage
-	RegExps   []*regexp.Regexp
+	TTL       time.Duration
+	Rules     []*Rule
+	Syslog    bool // If any rule needs the syslog header of the lines
 	Sources   []string
+	Listeners []string
 	Bucket    string
 	WhiteList []*net.IPNet
 	Template  *template.Template
+	Hooks     *gblist.Hooks
+	Enricher  *gblist.Enricher
+	Tags      []string
+	Workers   int
+	// Address serving the metrics, if any
+	MetricsListen string
+	// Address serving the backups, if any
+	BackupListen string
 }
 
 func main() {
 	config := flag.String("config", "", "YAML configuration file")
 	print := flag.Bool("print", false, "prints the content of the database after parsing")
+	follow := flag.Bool("follow", false, "keeps reading what is appended to the sources until interrupted; the configuration is reloaded on SIGHUP")
+	check := flag.Bool("check", false, "validates the configuration, without opening the database, and exits")
+	dryRun := flag.Bool("dry-run", false, "prints (to stderr) the records that would be added, extended or removed, without writing anything (nor running hooks)")
+	testPattern := flag.String("test-pattern", "", "prints the lines of the given file matched by the patterns, and the IPs extracted, without writing anything")
+	summary := flag.String("summary", "", "prints a summary of the run (lines read, matches per rule, records added, extended or allowlisted, errors) to stderr, as text or json")
+	summaryFile := flag.String("summary-file", "", "writes the summary of the run to the given file instead, as JSON unless -summary says otherwise")
 	flag.Parse()
 	if len(*config) == 0 {
 		log.Fatalf("Missing path to configuration file argument")
 	}
+	if len(*summaryFile) > 0 && len(*summary) == 0 {
+		*summary = "json"
+	}
+	if *summary != "" && *summary != "text" && *summary != "json" {
+		log.Fatalf("unknown summary format %s: it must be text or json", *summary)
+	}
 
 	cfg, err := loadConfig(*config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *check || len(*testPattern) > 0 {
+		// The database is not opened, as it may be locked by a running instance
+		settings, err := compileConfig(&cfg, nil)
+		if err == nil && *check {
+			err = checkSettings(&settings)
+			if err == nil {
+				fmt.Printf("configuration %s is valid\n", *config)
+			}
+		}
+		if err == nil && len(*testPattern) > 0 {
+			err = testPatterns(&settings, *testPattern, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	settings, err := parseConfig(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer settings.Storage.Close()
-
-	// Parses every source file and put the submatched IP into the database
-	for _, source := range cfg.Sources {
-		file, err := os.Open(source)
+	if *dryRun {
+		err = settings.Storage.DryRun()
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
+	r := newRunner(*config, &settings)
+	// fatal reports the error in the summary, if asked, and exits
+	fatal := func(err error) {
+		r.stats.error(err)
+		reportErr := report(r, *summary, *summaryFile, *dryRun)
+		if reportErr != nil {
+			log.Print(reportErr)
+		}
+		log.Fatal(err)
+	}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			for _, re := range settings.RegExps {
-				text := scanner.Text()
-				matches := re.FindAllStringSubmatch(text, -1)
-				for _, match := range matches {
-					ip := strings.TrimSpace(match[1])
-					var ipAddress net.IP
-					if len(ip) > 0 { // No reason to waste time on an empty string
-						if strings.Contains(ip, "/") { // Dirty check for getting CIDR
-							ipAddress, _, err = net.ParseCIDR(ip)
-							if err != nil { // With an error the ipAddress should be null anyway.
-								ipAddress = nil // We make sure, in any case.
-							}
-						} else { // Otherwise we assume is a single IP address
-							ipAddress = net.ParseIP(ip) // If it cannot be parsed it will return a nil
-						}
-						if ipAddress != nil {
-							if !isWhitelisted(ipAddress, settings.WhiteList) {
-								// Notice that given the way the storage library
-								// uses bolt API each add is a transaction, and
-								// in case of error whatever was added is not
-								// rolled back.
-								// Which is fine for my scope.
-								// Notice that we are adding the matching string, not the ipAddress
-								// as in case of a parsed CIDR is not what we want.
-								record, err := gblist.New(ip, settings.Storage.TTL, text)
-								if err == nil {
-									err = settings.Storage.Add(settings.Bucket, record)
-									if err != nil {
-										break
-									}
-								}
-							}
-						}
-					}
-				}
-
-			}
+	if *follow {
+		err = r.follow()
+	} else {
+		if len(settings.Listeners) > 0 {
+			log.Printf("listeners are only started with -follow")
 		}
-		if err != nil {
-			err = scanner.Err()
+		if len(settings.MetricsListen) > 0 {
+			log.Printf("metrics are only served with -follow")
 		}
-		file.Close()
-		if err != nil {
-			log.Fatal(err)
+		if len(settings.BackupListen) > 0 {
+			log.Printf("backups are only served with -follow")
 		}
+		err = r.read()
+	}
+	if err != nil {
+		fatal(err)
+	}
 
+	err = r.countAllowlisted(r.writer.Close())
+	if err != nil {
+		fatal(err)
+	}
+	settings = *r.current()
+	// Purge the expired records, so that their unban hook is run
+	if settings.Hooks != nil && !*print {
+		_, err = settings.Storage.List(settings.Bucket)
+		if err != nil {
+			fatal(err)
+		}
 	}
 
 	// If asked, print the blacklisted IPs for processing
 	if *print {
 		list, err := settings.Storage.List(settings.Bucket)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		for _, record := range list {
 			if settings.Template != nil {
@@ -131,33 +193,114 @@ func main() {
 		}
 	}
 
+	if *dryRun {
+		changes := settings.Storage.Changes()
+		gblist.WriteChanges(os.Stderr, changes)
+		for _, change := range changes {
+			if change.Bucket == settings.Bucket {
+				r.stats.change(change.Type)
+			}
+		}
+	}
+	settings.Storage.Close()
+	r.wait()
+	err = report(r, *summary, *summaryFile, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// parseConfig parses the YAML configuration and returns the setting (or an error)
+// report writes the summary of the run, if a format is given, to the file
+// or, if none, to stderr
+func report(r *runner, format string, path string, dryRun bool) error {
+	if len(format) == 0 {
+		return nil
+	}
+	summary := r.stats.summary(r.current().Rules)
+	summary.DryRun = dryRun
+	if len(path) == 0 {
+		return writeSummary(os.Stderr, format, summary)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeSummary(file, format, summary)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseConfig parses the YAML configuration, opening the database, and
+// returns the setting (or an error)
 func parseConfig(cfg *Config) (settings Settings, err error) {
+	storage, err := gblist.Open(cfg.Database, 0)
+	if err != nil {
+		return
+	}
+	storage.Actor = "goat-filter"
+	storage.Metrics = gblist.NewMetrics()
+	settings, err = compileConfig(cfg, &storage)
+	if err != nil {
+		storage.Close()
+		return
+	}
+	storage.TTL = settings.TTL
+	return
+}
+
+// compileConfig parses the YAML configuration, except for the database that
+// is already open, and returns the settings (or an error). Whitelist files
+// and buckets are read again every time.
+func compileConfig(cfg *Config, storage *gblist.Storage) (settings Settings, err error) {
+	settings.Config = *cfg
+	settings.Storage = storage
 	for _, element := range cfg.Sources {
 		source := strings.TrimSpace(element)
 		if len(source) > 0 {
 			settings.Sources = append(settings.Sources, strings.TrimSpace(source))
 		}
 	}
-	if len(settings.Sources) == 0 {
+	for _, element := range cfg.Listeners {
+		address := strings.TrimSpace(element)
+		if len(address) > 0 {
+			_, _, err = parseListener(address)
+			if err != nil {
+				return
+			}
+			settings.Listeners = append(settings.Listeners, address)
+		}
+	}
+	settings.MetricsListen = strings.TrimSpace(cfg.MetricsListen)
+	settings.BackupListen = strings.TrimSpace(cfg.BackupListen)
+	for _, listen := range [][2]string{{"metrics_listen", settings.MetricsListen}, {"backup_listen", settings.BackupListen}} {
+		if len(listen[1]) == 0 {
+			continue
+		}
+		if _, _, splitErr := net.SplitHostPort(listen[1]); splitErr != nil {
+			err = errors.New(fmt.Sprintf("invalid %s %s: %s", listen[0], listen[1], splitErr.Error()))
+			return
+		}
+	}
+	if len(settings.Sources) == 0 && len(settings.Listeners) == 0 {
 		err = errors.New("no valid source defined")
 		return
 	}
+	for _, source := range settings.Sources {
+		if _, matchErr := filepath.Match(source, ""); matchErr != nil {
+			err = errors.New(fmt.Sprintf("invalid source pattern %s: %s", source, matchErr.Error()))
+			return
+		}
+	}
 	TTLString := fmt.Sprintf("%dh", 21*24)
 	if len(cfg.TTL) > 0 {
 		TTLString = cfg.TTL
 	}
-	ttl, err := parseTTL(TTLString)
+	settings.TTL, err = parseTTL(TTLString)
 	if err != nil {
 		return
 	}
-	storage, err := gblist.Open(cfg.Database, ttl)
-	if err != nil {
-		return
-	}
-	settings.Storage = &storage
 	bucket := strings.TrimSpace(cfg.Bucket)
 	if len(bucket) > 0 {
 		settings.Bucket = bucket
@@ -165,25 +308,62 @@ func parseConfig(cfg *Config) (settings Settings, err error) {
 		err = errors.New("invalid bucket")
 		return
 	}
-	regExps := make([]*regexp.Regexp, 0)
+	ruleConfigs := make([]RuleConfig, 0, len(cfg.Patterns)+len(cfg.Rules))
 	for _, pattern := range cfg.Patterns {
-		re, compileErr := regexp.Compile(pattern)
-		if compileErr != nil {
-			err = errors.New(fmt.Sprintf("failed to compile regexp %s: %s", pattern, compileErr.Error()))
+		ruleConfigs = append(ruleConfigs, RuleConfig{Pattern: pattern})
+	}
+	for _, ruleConfig := range append(ruleConfigs, cfg.Rules...) {
+		if len(ruleConfig.DescriptionTemplate) == 0 {
+			ruleConfig.DescriptionTemplate = cfg.DescriptionTemplate
+		}
+		if len(ruleConfig.RawLine) == 0 {
+			ruleConfig.RawLine = cfg.RawLine
+		}
+		if ruleConfig.RawLineLength == 0 {
+			ruleConfig.RawLineLength = cfg.RawLineLength
+		}
+		rule, ruleErr := compileRule(ruleConfig)
+		if ruleErr != nil {
+			err = ruleErr
+			return
+		}
+		settings.Rules = append(settings.Rules, rule)
+		settings.Syslog = settings.Syslog || rule.Syslog
+	}
+	settings.WhiteList, err = loadWhitelist(cfg.WhiteList, settings.Storage)
+	if err != nil {
+		return
+	}
+	if len(cfg.OnBan) > 0 || len(cfg.OnUnban) > 0 {
+		var timeout time.Duration
+		if len(cfg.HookTimeout) > 0 {
+			timeout, err = time.ParseDuration(cfg.HookTimeout)
+			if err != nil {
+				err = errors.New(fmt.Sprintf("failed to parse hook timeout %s: %s", cfg.HookTimeout, err.Error()))
+				return
+			}
+		}
+		settings.Hooks, err = gblist.NewHooks(cfg.OnBan, cfg.OnUnban, timeout, cfg.HookConcurrency)
+		if err != nil {
 			return
 		}
-		regExps = append(regExps, re)
 	}
-	settings.RegExps = regExps
-	for _, address := range cfg.WhiteList {
-		_, ipNet, parseErr := net.ParseCIDR(address)
-		if parseErr != nil {
-			err = errors.New(fmt.Sprintf("failed to parse whitelisted CIDR %s: %s", address, parseErr.Error()))
+	if len(cfg.CountryDB) > 0 || len(cfg.ASNDB) > 0 {
+		settings.Enricher, err = gblist.OpenEnricher(cfg.CountryDB, cfg.ASNDB)
+		if err != nil {
 			return
-		} else {
-			settings.WhiteList = append(settings.WhiteList, ipNet)
 		}
 	}
+	settings.Tags = cfg.Tags
+	switch {
+	case cfg.Workers < 0:
+		err = errors.New(fmt.Sprintf("invalid number of workers %d", cfg.Workers))
+		return
+	case cfg.Workers == 0:
+		settings.Workers = runtime.NumCPU()
+	default:
+		settings.Workers = cfg.Workers
+	}
 	if len(cfg.Template) > 0 {
 		tmpl, err := template.New("print").Parse(cfg.Template)
 		if err != nil {
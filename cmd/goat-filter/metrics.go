@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/weregoat/gblist"
+	"io"
+	"net"
+	"net/http"
+)
+
+// serveMetrics serves the metrics of the database and of the run at
+// /metrics, in the Prometheus text format, until the listener is closed
+// (after closing done).
+func (r *runner) serveMetrics(ln net.Listener, done <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", gblist.MetricsHandler(r.current().Storage.WriteMetrics, r.writeMetrics))
+	r.serveHTTP(ln, mux, done)
+}
+
+// serveBackup serves a consistent backup of the database at /backup (no
+// other process can open it meanwhile), until the listener is closed (after
+// closing done).
+func (r *runner) serveBackup(ln net.Listener, done <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/backup", gblist.BackupHandler(r.current().Storage))
+	r.serveHTTP(ln, mux, done)
+}
+
+// serveHTTP serves the handler until the listener is closed, logging why it
+// stopped unless done is closed.
+func (r *runner) serveHTTP(ln net.Listener, handler http.Handler, done <-chan struct{}) {
+	err := http.Serve(ln, handler)
+	select {
+	case <-done:
+	default:
+		r.logError(err)
+	}
+}
+
+// writeMetrics writes the counters of the run
+func (r *runner) writeMetrics(w io.Writer) error {
+	summary := r.stats.summary(r.current().Rules)
+	lines := gblist.Metric{Name: "goat_filter_lines_total", Help: "Lines read, by source.", Type: "counter"}
+	for _, source := range summary.Sources {
+		lines.Samples = append(lines.Samples, gblist.Sample{Labels: map[string]string{"source": source.Source}, Value: float64(source.Lines)})
+	}
+	matches := gblist.Metric{Name: "goat_filter_rule_matches_total", Help: "Lines IPs were extracted from, by rule.", Type: "counter"}
+	ips := gblist.Metric{Name: "goat_filter_rule_ips_total", Help: "IPs extracted, by rule.", Type: "counter"}
+	for _, rule := range summary.Rules {
+		labels := map[string]string{"rule": rule.Rule}
+		matches.Samples = append(matches.Samples, gblist.Sample{Labels: labels, Value: float64(rule.Lines)})
+		ips.Samples = append(ips.Samples, gblist.Sample{Labels: labels, Value: float64(rule.IPs)})
+	}
+	whitelisted := gblist.Metric{Name: "goat_filter_ips_whitelisted_total", Help: "IPs extracted but whitelisted.", Type: "counter",
+		Samples: []gblist.Sample{{Value: float64(summary.Whitelisted)}}}
+	allowlisted := gblist.Metric{Name: "goat_filter_records_allowlisted_total", Help: "Records not written as in the allowlist of the database.", Type: "counter",
+		Samples: []gblist.Sample{{Value: float64(summary.Allowlisted)}}}
+	errors := gblist.Metric{Name: "goat_filter_errors_total", Help: "Errors that did not stop the run.", Type: "counter",
+		Samples: []gblist.Sample{{Value: float64(summary.Errors)}}}
+	return gblist.WritePrometheus(w, lines, matches, ips, whitelisted, allowlisted, errors)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/weregoat/gblist"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunner_ServeMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	storage.Metrics = gblist.NewMetrics()
+	cfg := Config{Sources: []string{"mail.log"}, Patterns: []string{pattern, saslPattern}, Bucket: "test"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	for _, line := range benchmarkLines(20) {
+		err = r.process("mail.log", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = r.writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		ln.Close()
+	}()
+	go r.serveMetrics(ln, done)
+	response, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+	expected := []string{
+		`goat_filter_lines_total{source="mail.log"} 20`,
+		`goat_filter_rule_matches_total{rule="` + strings.Replace(pattern, `\`, `\\`, -1) + `"} 2`,
+		`goat_filter_rule_matches_total{rule="` + strings.Replace(saslPattern, `\`, `\\`, -1) + `"} 0`,
+		`goat_filter_records_allowlisted_total 0`,
+		`goat_filter_errors_total 0`,
+		`gblist_records{bucket="test",version="4"} 2`,
+		`gblist_changes_total{action="add",bucket="test"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, metrics)
+		}
+	}
+	// The backups only have their own listener, if configured
+	response, err = http.Get("http://" + ln.Addr().String() + "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status %s of /backup next to the metrics", response.Status)
+	}
+}
+
+func TestRunner_ServeBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Sources: []string{"mail.log"}, Patterns: []string{pattern}, Bucket: "test", BackupListen: "127.0.0.1:0"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	err = r.process("mail.log", benchmarkLines(1)[0])
+	if err == nil {
+		err = r.writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", settings.BackupListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		ln.Close()
+	}()
+	go r.serveBackup(ln, done)
+	response, err := http.Get("http://" + ln.Addr().String() + "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "backup.db")
+	file, err := os.Create(path)
+	if err == nil {
+		_, err = io.Copy(file, response.Body)
+		file.Close()
+	}
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := gblist.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	record, err := backup.Fetch("test", "10.0.0.0")
+	if err != nil || record.IP != "10.0.0.0" {
+		t.Errorf("record missing from the backup (%v)", err)
+	}
+	response, err = http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status %s of /metrics next to the backups", response.Status)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"regexp/syntax"
+)
+
+// requiredLiteral returns the longest literal that every match of the
+// pattern contains, for skipping the lines without it before running the
+// regexp; empty if there is none, or the pattern is case insensitive there.
+func requiredLiteral(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	longest := ""
+	for _, literal := range literals(re.Simplify()) {
+		if len(literal) > len(longest) {
+			longest = literal
+		}
+	}
+	return longest
+}
+
+// literals returns the literals every match of the expression contains
+func literals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return literals(re.Sub[0])
+	case syntax.OpConcat:
+		var list []string
+		for _, sub := range re.Sub {
+			list = append(list, literals(sub)...)
+		}
+		return list
+	}
+	return nil // Alternations, and what can match nothing
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	pattern = `lost connection after (?:CONNECT|HELO|STARTTLS|EHLO|DATA|UNKNOWN) from [^[:space:]]+\[(?P<ip>[0-9\.:a-f]+)\]`
+	// Not starting with a literal, which the regexp package looks for anyway
+	saslPattern = `[^[:space:]]+\[(?P<ip>[0-9\.:a-f]+)\]: SASL LOGIN authentication failed`
+)
+
+func TestRequiredLiteral(t *testing.T) {
+	tests := map[string]string{
+		pattern:                                  "lost connection after ",
+		saslPattern:                              "]: SASL LOGIN authentication failed",
+		`Invalid user \S+ from (?P<ip>[0-9\.]+)`: "Invalid user ",
+		`(?:(?P<ip>[0-9\.]+) refused)+`:          " refused",
+		`(?i)invalid user (\S+)`:                 "",
+		`(foo|bar) ([0-9\.]+)`:                   " ",
+		`([0-9\.]+)`:                             "",
+		`(?:from )?([0-9\.]+)`:                   "",
+	}
+	for pattern, expected := range tests {
+		literal := requiredLiteral(pattern)
+		if literal != expected {
+			t.Errorf("expecting literal %q for %s, got %q", expected, pattern, literal)
+		}
+	}
+}
+
+func TestRule_Extract(t *testing.T) {
+	rule, err := compileRule(RuleConfig{Pattern: pattern})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range benchmarkLines(100) {
+		msg := message{Text: line}
+		filtered := rule.extract(&msg)
+		unfiltered := extractIPs(rule.Pattern, line)
+		if len(filtered) != len(unfiltered) {
+			t.Errorf("prefilter changed the IPs extracted from %s", line)
+		}
+	}
+}
+
+func BenchmarkRule_Extract(b *testing.B) {
+	lines := benchmarkLines(1000)
+	for name, pattern := range map[string]string{"lost": pattern, "sasl": saslPattern} {
+		rule, err := compileRule(RuleConfig{Pattern: pattern})
+		if err != nil {
+			b.Fatal(err)
+		}
+		literal := rule.Literal
+		for _, prefilter := range []bool{false, true} {
+			rule.Literal = ""
+			if prefilter {
+				rule.Literal = literal
+			}
+			b.Run(fmt.Sprintf("%s/prefilter=%t", name, prefilter), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					msg := message{Text: lines[i%len(lines)]}
+					rule.extract(&msg)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRunner_ReadFiles(b *testing.B) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	var groups [][]string
+	for i := 0; i < 8; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("mail.log.%d", i))
+		err = ioutil.WriteFile(path, []byte(strings.Join(benchmarkLines(10000), "\n")), 0600)
+		if err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, path)
+		groups = append(groups, []string{path})
+	}
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Sources: files, Patterns: []string{pattern}, Bucket: "test"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := r.readFiles(groups, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	err = r.writer.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchmarkLines returns n lines of a mail log, one in ten matching pattern
+func benchmarkLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		if i%10 == 0 {
+			lines[i] = fmt.Sprintf("Oct 17 10:00:00 mx postfix/smtpd[%d]: lost connection after EHLO from unknown[10.0.%d.%d]", i, (i>>8)&0xff, i&0xff)
+		} else {
+			lines[i] = fmt.Sprintf("Oct 17 10:00:00 mx postfix/smtpd[%d]: connect from mail.example.org[192.0.2.%d]", i, i&0xff)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// RuleConfig is the definition of a rule in the YAML configuration: the
+// pattern extracting the IP, and the conditions on where the message comes
+// from (all optional). Program and hostname are regular expressions;
+// facility is a syslog facility name (like "mail" or "authpriv") or number.
+// Rules with format json take the IP from a field of messages that are JSON
+// objects instead, if they satisfy the conditions on the other fields.
+type RuleConfig struct {
+	Name     string `yaml:"name"`
+	Pattern  string `yaml:"pattern"`
+	Program  string `yaml:"program"`
+	Hostname string `yaml:"hostname"`
+	Facility string `yaml:"facility"`
+	// text (the default) or json
+	Format string `yaml:"format"`
+	// Path of the field with the IP, like request.remote_ip
+	IPField string `yaml:"ip_field"`
+	// Element of ip_field taken when it's a list, counting from 1, or from
+	// the end if negative; by default (0) the last one
+	IPIndex int `yaml:"ip_index"`
+	// Like "status >= 400" or "request.uri =~ ^/wp-"
+	Conditions []string `yaml:"conditions"`
+	// Fields added to the metadata of the records, besides those of the conditions
+	Fields []string `yaml:"fields"`
+	// Go template of the description of the records, instead of the raw line
+	DescriptionTemplate string `yaml:"description_template"`
+	// full (the default), truncate (to raw_line_length characters), hash or omit
+	RawLine       string `yaml:"raw_line"`
+	RawLineLength int    `yaml:"raw_line_length"`
+}
+
+// Rule is a compiled rule
+type Rule struct {
+	Name       string
+	Pattern    *regexp.Regexp
+	Literal    string // In every match of the pattern, if not empty
+	Program    *regexp.Regexp
+	Hostname   *regexp.Regexp
+	Facility   int // -1 for any
+	JSON       bool
+	IPField    []string
+	IPIndex    int // Counting from 1, or from the end if negative
+	Conditions []*condition
+	Fields     []string // Of the conditions too
+	// Description is nil for the raw line
+	Description   *template.Template
+	RawLine       string
+	RawLineLength int
+	// Syslog is set if the rule needs the syslog header of the lines read
+	// from files, for its conditions or its description
+	Syslog bool
+}
+
+// extraction is an IP (or CIDR) extracted from a message
+type extraction struct {
+	IP      string
+	Address net.IP // The network one, for a CIDR
+	// The named groups of the pattern or, for JSON rules, the fields to add
+	// to the metadata
+	Fields map[string]string
+}
+
+// message is a line of a source, or a syslog message, with what is known
+// of where it comes from.
+type message struct {
+	Text     string // What the patterns are matched against
+	Content  string // Without the syslog header, if any
+	Program  string
+	Hostname string
+	Facility int       // -1 if unknown
+	Time     time.Time // Zero if unknown
+	Meta     map[string]string
+	document interface{} // Content decoded, for the JSON rules
+	decoded  bool
+	invalid  bool // Content is not a JSON object
+}
+
+// facilities are the names of the syslog facilities
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// compileRule compiles the rule from its configuration
+func compileRule(cfg RuleConfig) (*Rule, error) {
+	rule := &Rule{
+		Name:     strings.TrimSpace(cfg.Name),
+		Facility: -1,
+	}
+	var err error
+	switch strings.ToLower(strings.TrimSpace(cfg.Format)) {
+	case "", "text":
+		if len(cfg.IPField) > 0 || cfg.IPIndex != 0 || len(cfg.Conditions) > 0 || len(cfg.Fields) > 0 {
+			return nil, errors.New(fmt.Sprintf("%s: ip_field, ip_index, conditions and fields need format json", ruleLabel(rule.Name)))
+		}
+		rule.Pattern, err = regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to compile regexp %s: %s", cfg.Pattern, err.Error()))
+		}
+		if rule.Pattern.NumSubexp() == 0 {
+			return nil, errors.New(fmt.Sprintf("regexp %s has no group for the IP, like (?P<ip>...)", cfg.Pattern))
+		}
+		rule.Literal = requiredLiteral(cfg.Pattern)
+	case "json":
+		err = compileJSONRule(rule, cfg)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unknown format %s", ruleLabel(rule.Name), cfg.Format))
+	}
+	err = compileDescription(rule, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Program) > 0 {
+		rule.Program, err = regexp.Compile(cfg.Program)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to compile program regexp %s: %s", cfg.Program, err.Error()))
+		}
+	}
+	if len(cfg.Hostname) > 0 {
+		rule.Hostname, err = regexp.Compile(cfg.Hostname)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to compile hostname regexp %s: %s", cfg.Hostname, err.Error()))
+		}
+	}
+	if facility := strings.ToLower(strings.TrimSpace(cfg.Facility)); len(facility) > 0 {
+		rule.Facility = parseFacility(facility)
+		if rule.Facility < 0 {
+			return nil, errors.New(fmt.Sprintf("unknown syslog facility %s", cfg.Facility))
+		}
+	}
+	// JSON rules decode what follows the header
+	rule.Syslog = rule.JSON || rule.Program != nil || rule.Hostname != nil || rule.Facility >= 0 ||
+		usesFields(rule.Description, "Time", "Program", "Hostname")
+	return rule, nil
+}
+
+// compileJSONRule compiles the field selectors of a JSON rule
+func compileJSONRule(rule *Rule, cfg RuleConfig) error {
+	if len(cfg.Pattern) > 0 {
+		return errors.New(fmt.Sprintf("%s: a json rule has no pattern; use conditions", ruleLabel(rule.Name)))
+	}
+	field := strings.TrimSpace(cfg.IPField)
+	if len(field) == 0 {
+		return errors.New(fmt.Sprintf("%s: a json rule needs ip_field", ruleLabel(rule.Name)))
+	}
+	rule.JSON = true
+	rule.IPField = splitPath(field)
+	rule.IPIndex = cfg.IPIndex
+	if rule.IPIndex == 0 {
+		rule.IPIndex = -1
+	}
+	for _, text := range cfg.Conditions {
+		c, err := parseCondition(text)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", ruleLabel(rule.Name), err.Error()))
+		}
+		rule.Conditions = append(rule.Conditions, c)
+		if !contains(rule.Fields, c.field) {
+			rule.Fields = append(rule.Fields, c.field)
+		}
+	}
+	for _, field := range cfg.Fields {
+		field = strings.TrimSpace(field)
+		if len(field) > 0 && !contains(rule.Fields, field) {
+			rule.Fields = append(rule.Fields, field)
+		}
+	}
+	return nil
+}
+
+// ruleLabel returns how a rule is called in the errors
+func ruleLabel(name string) string {
+	if len(name) > 0 {
+		return "rule " + name
+	}
+	return "rule"
+}
+
+// parseFacility returns the number of the facility, given its name or
+// number, or -1 if unknown
+func parseFacility(facility string) int {
+	for i, name := range facilities {
+		if name == facility {
+			return i
+		}
+	}
+	n, err := strconv.Atoi(facility)
+	if err != nil || n < 0 || n >= len(facilities) {
+		return -1
+	}
+	return n
+}
+
+// String returns the name of the rule or, if it has none, its pattern
+func (r *Rule) String() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	if r.JSON {
+		return "json:" + strings.Join(r.IPField, ".")
+	}
+	return r.Pattern.String()
+}
+
+// matches returns if the message satisfies the conditions of the rule; a
+// message missing what a condition is on (like the facility of a line from
+// a file) does not.
+func (r *Rule) matches(msg *message) bool {
+	if r.Program != nil && (len(msg.Program) == 0 || !r.Program.MatchString(msg.Program)) {
+		return false
+	}
+	if r.Hostname != nil && (len(msg.Hostname) == 0 || !r.Hostname.MatchString(msg.Hostname)) {
+		return false
+	}
+	if r.Facility >= 0 && r.Facility != msg.Facility {
+		return false
+	}
+	return true
+}
+
+// extract returns the IPs (or CIDRs) the rule finds in the message
+func (r *Rule) extract(msg *message) []extraction {
+	if !r.JSON {
+		if len(r.Literal) > 0 && !strings.Contains(msg.Text, r.Literal) {
+			return nil // Much cheaper than not matching the regexp
+		}
+		return extractIPs(r.Pattern, msg.Text)
+	}
+	if !msg.decoded {
+		var err error
+		msg.document, err = decodeJSON(msg.Content)
+		msg.invalid = err != nil
+		msg.decoded = true
+	}
+	if msg.invalid {
+		return nil
+	}
+	for _, c := range r.Conditions {
+		if !c.matches(msg.document) {
+			return nil
+		}
+	}
+	value, ok := lookup(msg.document, r.IPField)
+	if !ok {
+		return nil
+	}
+	ip, address := jsonIP(value, r.IPIndex)
+	if address == nil {
+		return nil
+	}
+	fields := make(map[string]string)
+	for _, field := range r.Fields {
+		if value, ok := lookup(msg.document, splitPath(field)); ok {
+			fields[field] = fieldString(value)
+		}
+	}
+	return []extraction{{IP: ip, Address: address, Fields: fields}}
+}
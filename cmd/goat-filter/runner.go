@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// runner parses the sources with the settings in use, which can be swapped
+// (on reload) while it runs.
+type runner struct {
+	configPath string
+	settings   atomic.Value // *Settings
+	writer     *gblist.BatchWriter
+	hooks      *gblist.Hooks  // The last ones run, only used by the dispatcher
+	retired    sync.WaitGroup // Hooks replaced on reload, still running
+	dispatcher sync.WaitGroup
+	stats      *stats
+}
+
+// newRunner returns a runner with the given settings, running their hooks
+// (and those of the settings swapped in later) for the changes to the bucket.
+func newRunner(configPath string, settings *Settings) *runner {
+	r := &runner{
+		configPath: configPath,
+		writer:     settings.Storage.NewBatchWriter(settings.Bucket, batchSize, batchInterval),
+		stats:      newStats(),
+	}
+	r.swap(settings)
+	changes := settings.Storage.Watch(settings.Bucket)
+	r.dispatcher.Add(1)
+	go func() {
+		defer r.dispatcher.Done()
+		for change := range changes {
+			r.stats.change(change.Type)
+			hooks := r.current().Hooks
+			if hooks != r.hooks {
+				r.retire(r.hooks)
+				r.hooks = hooks
+			}
+			if hooks != nil {
+				hooks.Run(change)
+			}
+		}
+	}()
+	return r
+}
+
+// current returns the settings in use
+func (r *runner) current() *Settings {
+	return r.settings.Load().(*Settings)
+}
+
+// swap replaces the settings in use
+func (r *runner) swap(settings *Settings) {
+	r.settings.Store(settings)
+}
+
+// retire waits in the background for the hooks replaced on reload to
+// complete, forgetting them afterwards. Only the dispatcher runs hooks, so
+// nothing new is started with them once it has moved on.
+func (r *runner) retire(hooks *gblist.Hooks) {
+	if hooks == nil {
+		return
+	}
+	r.retired.Add(1)
+	go func() {
+		defer r.retired.Done()
+		hooks.Wait()
+	}()
+}
+
+// wait waits for the hooks to complete; it should be called after closing the storage.
+func (r *runner) wait() {
+	r.dispatcher.Wait()
+	r.retired.Wait()
+	if r.hooks != nil {
+		r.hooks.Wait()
+	}
+}
+
+// read parses every source file once, and puts the submatched IPs into the database
+func (r *runner) read() error {
+	settings := r.current()
+	groups, err := expandSources(settings.Sources)
+	if err != nil {
+		return err
+	}
+	return r.readFiles(groups, settings.Workers)
+}
+
+// readFiles reads the groups of files, up to workers of them at once,
+// stopping at the first error. The files of a group (those matched by a
+// glob pattern) are read one after the other, in their order, so that the
+// records and their history are updated oldest line first. They all write
+// to the same batch writer.
+func (r *runner) readFiles(groups [][]string, workers int) error {
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+	paths := make(chan []string)
+	stop := make(chan struct{})
+	var once sync.Once
+	var err error
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range paths {
+				for _, path := range group {
+					readErr := r.readFile(path)
+					if readErr != nil {
+						once.Do(func() {
+							err = readErr
+							close(stop)
+						})
+						break
+					}
+				}
+			}
+		}()
+	}
+feed:
+	for _, group := range groups {
+		select {
+		case paths <- group:
+		case <-stop:
+			break feed
+		}
+	}
+	close(paths)
+	wg.Wait()
+	return err
+}
+
+// readFile parses a whole file (decompressing it, if needed), or a stream
+// up to when its writer closes it. A file compressed with a format that
+// cannot be read is logged and skipped, as it's likely an old rotated log
+// matched by a glob pattern.
+func (r *runner) readFile(path string) error {
+	file, err := openSource(path)
+	if _, ok := err.(unsupportedError); ok {
+		r.logError(errors.New(fmt.Sprintf("%s; skipped", err.Error())))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	name := sourceName(path)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		err = r.process(name, scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// process puts the IPs submatched in a line of the source into the database,
+// returning an error only if writing them failed.
+func (r *runner) process(source string, text string) error {
+	atomic.AddInt64(r.stats.source(source), 1)
+	msg := parseLine(text, r.current().Syslog)
+	return r.handle(source, &msg)
+}
+
+// handle puts the IPs submatched in the message by the rules it satisfies
+// into the database, returning an error only if writing them failed.
+func (r *runner) handle(source string, msg *message) error {
+	settings := r.current()
+	for _, rule := range settings.Rules {
+		if !rule.matches(msg) {
+			continue
+		}
+		extractions := rule.extract(msg)
+		if len(extractions) > 0 {
+			counters := r.stats.rule(rule.String())
+			atomic.AddInt64(&counters.lines, 1)
+			atomic.AddInt64(&counters.ips, int64(len(extractions)))
+			atomic.AddInt64(&r.stats.extracted, int64(len(extractions)))
+		}
+		for _, ex := range extractions {
+			if isWhitelisted(ex.Address, settings.WhiteList) {
+				atomic.AddInt64(&r.stats.whitelisted, 1)
+				continue
+			}
+			// Records are written in batches, each one a
+			// transaction; in case of error whatever was
+			// written before is not rolled back.
+			// Which is fine for my scope.
+			// Notice that we are adding the matching string, not the ipAddress
+			// as in case of a parsed CIDR is not what we want.
+			description, err := rule.describe(ex, msg, source)
+			if err != nil {
+				r.logError(err) // The raw line is used instead
+			}
+			record, err := gblist.New(ex.IP, settings.TTL, description)
+			if err == nil {
+				record.Source = source
+				record.Rule = rule.String()
+				record.AddTags(settings.Tags...)
+				for k, v := range msg.Meta {
+					record.SetMeta(k, v)
+				}
+				if rule.JSON {
+					for k, v := range ex.Fields {
+						record.SetMeta(k, v)
+					}
+				}
+				if settings.Enricher != nil {
+					err = settings.Enricher.Enrich(&record)
+				}
+			}
+			if err == nil {
+				err = r.countAllowlisted(r.writer.Add(record))
+				if err != nil {
+					return err
+				}
+			} else {
+				r.logError(errors.New(fmt.Sprintf("failed to create the record of %s: %s", ex.IP, err.Error())))
+			}
+		}
+	}
+	return nil
+}
+
+// extractIPs returns the IPs (or CIDRs) submatched by the pattern in the
+// text, with the named groups of their match.
+func extractIPs(re *regexp.Regexp, text string) []extraction {
+	var extractions []extraction
+	group := ipGroup(re)
+	matches := re.FindAllStringSubmatch(text, -1)
+	for _, match := range matches {
+		ip := strings.TrimSpace(match[group])
+		ipAddress := parseAddress(ip)
+		if ipAddress != nil {
+			groups := make(map[string]string)
+			for i, name := range re.SubexpNames() {
+				if len(name) > 0 {
+					groups[name] = match[i]
+				}
+			}
+			extractions = append(extractions, extraction{IP: ip, Address: ipAddress, Fields: groups})
+		}
+	}
+	return extractions
+}
+
+// parseAddress returns the address of an IP or, for a CIDR, of its network;
+// nil if it's neither.
+func parseAddress(ip string) net.IP {
+	var ipAddress net.IP
+	if len(ip) == 0 { // No reason to waste time on an empty string
+		return nil
+	}
+	if strings.Contains(ip, "/") { // Dirty check for getting CIDR
+		var err error
+		ipAddress, _, err = net.ParseCIDR(ip)
+		if err != nil { // With an error the ipAddress should be null anyway.
+			ipAddress = nil // We make sure, in any case.
+		}
+	} else { // Otherwise we assume is a single IP address
+		ipAddress = net.ParseIP(ip) // If it cannot be parsed it will return a nil
+	}
+	return ipAddress
+}
+
+// ipGroup returns the index of the group named "ip" of the pattern or, if
+// there is none, of the first group.
+func ipGroup(re *regexp.Regexp) int {
+	for i, name := range re.SubexpNames() {
+		if name == "ip" {
+			return i
+		}
+	}
+	return 1
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Magic bytes of the compression formats
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// source is a source file, decompressed if needed
+type source struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *source) Close() error {
+	return s.file.Close()
+}
+
+// unsupportedError is returned when opening a file compressed with a format
+// the standard library cannot read, if the command decompressing it is not
+// installed either.
+type unsupportedError struct {
+	path   string
+	format string
+}
+
+func (e unsupportedError) Error() string {
+	return fmt.Sprintf("%s is compressed with %s, which cannot be read without the %s command", e.path, e.format, e.format)
+}
+
+// decompressor reads the output of a command decompressing a file; at the end
+// of it the error of the command, if any, is returned.
+type decompressor struct {
+	cmd    *exec.Cmd
+	out    io.Reader
+	stderr bytes.Buffer
+	done   bool
+}
+
+// startDecompressor runs the command (zstd or xz) decompressing what is read from r
+func startDecompressor(format string, path string, r io.Reader) (*decompressor, error) {
+	program, err := exec.LookPath(format)
+	if err != nil {
+		return nil, unsupportedError{path: path, format: format}
+	}
+	c := &decompressor{cmd: exec.Command(program, "-dc")}
+	c.cmd.Stdin = r
+	c.cmd.Stderr = &c.stderr
+	c.out, err = c.cmd.StdoutPipe()
+	if err == nil {
+		err = c.cmd.Start()
+	}
+	return c, err
+}
+
+func (c *decompressor) Read(p []byte) (int, error) {
+	n, err := c.out.Read(p)
+	if err == io.EOF && !c.done {
+		c.done = true
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			err = errors.New(fmt.Sprintf("%s: %s", waitErr.Error(), strings.TrimSpace(c.stderr.String())))
+		}
+	}
+	return n, err
+}
+
+// close stops the command, if not done yet
+func (c *decompressor) close() {
+	if !c.done {
+		c.done = true
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}
+}
+
+// isStdin returns if the source stands for the standard input
+func isStdin(path string) bool {
+	return path == "-" || path == "stdin"
+}
+
+// isStream returns if the source is the standard input or a named pipe,
+// which are read as they are written to, until the writer closes them.
+func isStream(path string) bool {
+	if isStdin(path) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// sourceName returns the name of the source, as written in the records
+func sourceName(path string) string {
+	if isStdin(path) {
+		return "stdin"
+	}
+	return path
+}
+
+// openSource opens a source file, decompressing it transparently if it's
+// compressed with gzip or bzip2 (as told by its first bytes, not its name);
+// zstd and xz files are decompressed with the zstd and xz commands, if
+// installed, or an unsupportedError is returned.
+// Streams are never decompressed, not to wait for more than a line.
+func openSource(path string) (io.ReadCloser, error) {
+	if isStdin(path) {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		return file, nil
+	}
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(len(xzMagic)) // Shorter files are plain text anyway
+	s := &source{Reader: buffered, file: file}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		s.Reader, err = gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		s.Reader = bzip2.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return s.decompress("zstd", path)
+	case bytes.HasPrefix(magic, xzMagic):
+		return s.decompress("xz", path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("failed to read %s: %s", path, err.Error()))
+	}
+	return s, nil
+}
+
+// decompress returns the source read through the command decompressing it
+func (s *source) decompress(format string, path string) (io.ReadCloser, error) {
+	c, err := startDecompressor(format, path, s.Reader)
+	if _, ok := err.(unsupportedError); ok {
+		s.file.Close()
+		return nil, err
+	}
+	if err != nil {
+		s.file.Close()
+		return nil, errors.New(fmt.Sprintf("failed to read %s: %s", path, err.Error()))
+	}
+	return &decompressedSource{decompressor: c, file: s.file}, nil
+}
+
+// decompressedSource is a source file read through a command
+type decompressedSource struct {
+	*decompressor
+	file *os.File
+}
+
+func (s *decompressedSource) Close() error {
+	s.decompressor.close()
+	return s.file.Close()
+}
+
+// isCompressed returns if the file starts with the magic bytes of a
+// compression format
+func isCompressed(path string) bool {
+	if isStream(path) {
+		return false // Not to consume, nor wait for, what is written to it
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, len(xzMagic))
+	n, _ := io.ReadFull(file, magic)
+	magic = magic[:n]
+	for _, m := range [][]byte{gzipMagic, bzip2Magic, zstdMagic, xzMagic} {
+		if bytes.HasPrefix(magic, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSources returns the files matched by each source, in the order they
+// are configured; the files matched by a glob pattern (like
+// /var/log/mail.log*) are sorted oldest first, by modification time.
+// Sources that are not patterns are returned as they are, even if missing.
+func expandSources(sources []string) ([][]string, error) {
+	var files [][]string
+	for _, pattern := range sources {
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, []string{pattern})
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid source pattern %s: %s", pattern, err.Error()))
+		}
+		times := make(map[string]int64)
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil {
+				times[match] = info.ModTime().UnixNano()
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool {
+			return times[matches[i]] < times[matches[j]]
+		})
+		if len(matches) > 0 {
+			files = append(files, matches)
+		}
+	}
+	return files, nil
+}
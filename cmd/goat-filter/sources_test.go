@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// content is what the test sources contain, compressed or not
+const content = "one\ntwo\n"
+
+// bzip2Content is content compressed with bzip2
+var bzip2Content = []byte{66, 90, 104, 57, 49, 65, 89, 38, 83, 89, 167, 20, 43, 119, 0, 0, 2, 193, 128, 0, 16, 2, 1, 132, 128, 32, 0, 33, 128, 12, 2, 56, 245, 27, 139, 185, 34, 156, 40, 72, 83, 138, 21, 187, 128}
+
+func TestOpenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write([]byte(content))
+	w.Close()
+	files := map[string][]byte{
+		"plain":    []byte(content),
+		"gzip.log": gzipped.Bytes(), // The name does not matter
+		"bzip2":    bzip2Content,
+	}
+	for _, format := range []string{"zstd", "xz"} {
+		if _, err := exec.LookPath(format); err != nil {
+			t.Logf("%s not installed; not tested", format)
+			continue
+		}
+		cmd := exec.Command(format, "-c")
+		cmd.Stdin = bytes.NewBufferString(content)
+		files[format], err = cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := openSource(path)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		read, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || string(read) != content {
+			t.Errorf("%s: wrong content %q (%v)", name, read, err)
+		}
+		if compressed := name != "plain"; isCompressed(path) != compressed {
+			t.Errorf("%s: wrong compression detected", name)
+		}
+	}
+
+	// Corrupt data after the magic bytes
+	if _, err := exec.LookPath("xz"); err == nil {
+		path := filepath.Join(dir, "corrupt.xz")
+		err = ioutil.WriteFile(path, append(append([]byte{}, xzMagic...), "garbage"...), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := openSource(path)
+		if err == nil {
+			_, err = ioutil.ReadAll(file)
+			file.Close()
+		}
+		if err == nil {
+			t.Errorf("no error reading a corrupt xz file")
+		}
+	}
+}
+
+func TestRunner_ReadFile_Unsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Without the zstd command, a zstd file cannot be read
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir)
+	source := filepath.Join(dir, "mail.log.1.zst")
+	err = ioutil.WriteFile(source, append(append([]byte{}, zstdMagic...), "frame"...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openSource(source)
+	if _, ok := err.(unsupportedError); !ok {
+		t.Errorf("wrong error opening a zstd file without zstd: %v", err)
+	}
+
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Sources: []string{filepath.Join(dir, "mail.log*")}, Patterns: []string{pattern}, Bucket: "test"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	defer r.writer.Close()
+	err = r.read()
+	if err != nil {
+		t.Errorf("unsupported file not skipped: %s", err)
+	}
+	if errors := r.stats.summary(settings.Rules).Errors; errors != 1 {
+		t.Errorf("wrong number of errors %d", errors)
+	}
+}
+
+func TestExpandSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	// Named so that the alphabetical order is not the right one
+	ages := map[string]time.Duration{
+		"mail.log":      0,
+		"mail.log.1":    time.Hour,
+		"mail.log.2.gz": 2 * time.Hour,
+		"mail.log.10":   10 * time.Hour,
+	}
+	for name, age := range ages {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, nil, 0600)
+		if err == nil {
+			err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := expandSources([]string{"stdin", filepath.Join(dir, "mail.log*"), filepath.Join(dir, "nothing.log*"), filepath.Join(dir, "missing.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotated []string
+	for _, name := range []string{"mail.log.10", "mail.log.2.gz", "mail.log.1", "mail.log"} {
+		rotated = append(rotated, filepath.Join(dir, name))
+	}
+	expected := [][]string{{"stdin"}, rotated, {filepath.Join(dir, "missing.log")}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("wrong files %q", files)
+	}
+	_, err = expandSources([]string{filepath.Join(dir, "mail.log[")})
+	if err == nil {
+		t.Errorf("no error expanding an invalid pattern")
+	}
+}
+
+func TestRunner_Read_Order(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The same IP in every rotated file, the newest last: whatever the
+	// workers, the record must end up with the line of the newest file
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		name := "mail.log"
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+		path := filepath.Join(dir, name)
+		line := "lost connection after EHLO from unknown[192.0.2.1] in " + name + "\n"
+		err = ioutil.WriteFile(path, []byte(strings.Repeat(line, 5000)), 0600)
+		if err == nil {
+			age := time.Duration(i) * time.Hour
+			err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another source, read at the same time
+	other := filepath.Join(dir, "other.log")
+	err = ioutil.WriteFile(other, []byte(strings.Join(benchmarkLines(5000), "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Sources: []string{filepath.Join(dir, "mail.log*"), other}, Patterns: []string{pattern}, Bucket: "test", Workers: 8}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	err = r.read()
+	if err == nil {
+		err = r.writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := storage.Fetch("test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "lost connection after EHLO from unknown[192.0.2.1] in mail.log"; record.Description != expected {
+		t.Errorf("wrong description %q (expected %q)", record.Description, expected)
+	}
+	if record, err = storage.Fetch("test", "10.0.0.0"); err != nil || record.IP != "10.0.0.0" {
+		t.Errorf("other source not read (%v)", err)
+	}
+}
+
+func TestRunner_ReadFile_NamedPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.fifo")
+	err = syscall.Mkfifo(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isStream(path) {
+		t.Errorf("named pipe not read as a stream")
+	}
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Sources: []string{path}, Patterns: []string{pattern}, Bucket: "test"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	r.writer = storage.NewBatchWriter("test", 1, 0)
+	defer r.writer.Close()
+	// write opens the pipe (waiting for a reader), writes the lines of the
+	// given IPs and closes it.
+	write := func(ips ...string) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			pipe, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err == nil {
+				for _, ip := range ips {
+					_, err = pipe.WriteString("lost connection after EHLO from unknown[" + ip + "]\n")
+				}
+				pipe.Close()
+			}
+			done <- err
+		}()
+		return done
+	}
+	listed := func(ip string) bool {
+		record, err := storage.Fetch("test", ip)
+		return err == nil && record.IP == ip
+	}
+
+	// Read once, up to the writer closing the pipe
+	written := write("192.0.2.1", "192.0.2.2")
+	err = r.readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if !listed(ip) {
+			t.Errorf("%s not listed", ip)
+		}
+	}
+	if record, _ := storage.Fetch("test", "192.0.2.1"); record.Source != path {
+		t.Errorf("wrong source %q", record.Source)
+	}
+
+	// Followed, the pipe is opened again for the next writer
+	errs := make(chan error, 1)
+	closed := make(chan struct{})
+	go r.stream(path, errs, closed)
+	for _, ip := range []string{"192.0.2.3", "192.0.2.4"} {
+		select {
+		case err = <-write(ip):
+			if err != nil {
+				t.Fatal(err)
+			}
+		case err = <-errs:
+			t.Fatalf("stream stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pipe not opened again for %s", ip)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !listed(ip) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !listed(ip) {
+			t.Errorf("%s not listed", ip)
+		}
+	}
+	select {
+	case <-closed:
+		t.Errorf("named pipe handled as the standard input")
+	default:
+	}
+}
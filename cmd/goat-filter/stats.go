@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats counts what happens during a run, for the summary. It's safe for
+// concurrent use.
+type stats struct {
+	started     time.Time
+	mutex       sync.RWMutex
+	sources     map[string]*int64 // Lines read
+	sourceOrder []string
+	rules       map[string]*ruleCounters
+	ruleOrder   []string
+	extracted   int64
+	whitelisted int64
+	allowlisted int64 // Records not written, as in the allowlist of the database
+	changes     map[gblist.ChangeType]*int64
+	errors      int64
+	lastError   string
+}
+
+// ruleCounters are the counters of a rule
+type ruleCounters struct {
+	lines int64 // With at least an IP extracted
+	ips   int64
+}
+
+// Summary is the report of a run
+type Summary struct {
+	Started     time.Time       `json:"started"`
+	Duration    float64         `json:"duration_seconds"`
+	DryRun      bool            `json:"dry_run"`
+	Sources     []SourceSummary `json:"sources"`
+	Rules       []RuleSummary   `json:"rules"`
+	Extracted   int64           `json:"ips_extracted"`
+	Whitelisted int64           `json:"ips_whitelisted"`
+	Allowlisted int64           `json:"allowlisted"`
+	Added       int64           `json:"added"`
+	Extended    int64           `json:"extended"`
+	Removed     int64           `json:"removed"`
+	Expired     int64           `json:"expired"`
+	Errors      int64           `json:"errors"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// SourceSummary is the report of a source
+type SourceSummary struct {
+	Source string `json:"source"`
+	Lines  int64  `json:"lines"`
+}
+
+// RuleSummary is the report of a rule: the lines it extracted IPs from,
+// and how many
+type RuleSummary struct {
+	Rule  string `json:"rule"`
+	Lines int64  `json:"lines"`
+	IPs   int64  `json:"ips"`
+}
+
+// newStats returns the stats of a run starting now
+func newStats() *stats {
+	s := &stats{
+		started: time.Now(),
+		sources: make(map[string]*int64),
+		rules:   make(map[string]*ruleCounters),
+		changes: make(map[gblist.ChangeType]*int64),
+	}
+	for _, changeType := range gblist.ChangeTypes {
+		s.changes[changeType] = new(int64)
+	}
+	return s
+}
+
+// source returns the line counter of the source
+func (s *stats) source(name string) *int64 {
+	s.mutex.RLock()
+	counter, ok := s.sources[name]
+	s.mutex.RUnlock()
+	if ok {
+		return counter
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counter, ok = s.sources[name]
+	if !ok {
+		counter = new(int64)
+		s.sources[name] = counter
+		s.sourceOrder = append(s.sourceOrder, name)
+	}
+	return counter
+}
+
+// rule returns the counters of the rule
+func (s *stats) rule(name string) *ruleCounters {
+	s.mutex.RLock()
+	counters, ok := s.rules[name]
+	s.mutex.RUnlock()
+	if ok {
+		return counters
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counters, ok = s.rules[name]
+	if !ok {
+		counters = &ruleCounters{}
+		s.rules[name] = counters
+		s.ruleOrder = append(s.ruleOrder, name)
+	}
+	return counters
+}
+
+// change counts a change to the bucket
+func (s *stats) change(changeType gblist.ChangeType) {
+	if counter, ok := s.changes[changeType]; ok {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+// error counts an error
+func (s *stats) error(err error) {
+	atomic.AddInt64(&s.errors, 1)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError = err.Error()
+}
+
+// summary returns the report of the run so far; the rules in use are listed
+// even if they matched nothing, followed by those used before a reload.
+func (s *stats) summary(rules []*Rule) Summary {
+	for _, rule := range rules {
+		s.rule(rule.String())
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	summary := Summary{
+		Started:     s.started,
+		Duration:    time.Since(s.started).Seconds(),
+		Sources:     []SourceSummary{},
+		Rules:       []RuleSummary{},
+		Extracted:   atomic.LoadInt64(&s.extracted),
+		Whitelisted: atomic.LoadInt64(&s.whitelisted),
+		Allowlisted: atomic.LoadInt64(&s.allowlisted),
+		Added:       atomic.LoadInt64(s.changes[gblist.Added]),
+		Extended:    atomic.LoadInt64(s.changes[gblist.Updated]),
+		Removed:     atomic.LoadInt64(s.changes[gblist.Removed]),
+		Expired:     atomic.LoadInt64(s.changes[gblist.Expired]),
+		Errors:      atomic.LoadInt64(&s.errors),
+		LastError:   s.lastError,
+	}
+	for _, name := range s.sourceOrder {
+		summary.Sources = append(summary.Sources, SourceSummary{Source: name, Lines: atomic.LoadInt64(s.sources[name])})
+	}
+	for _, name := range s.ruleOrder {
+		counters := s.rules[name]
+		summary.Rules = append(summary.Rules, RuleSummary{
+			Rule:  name,
+			Lines: atomic.LoadInt64(&counters.lines),
+			IPs:   atomic.LoadInt64(&counters.ips),
+		})
+	}
+	return summary
+}
+
+// writeSummary writes the summary as text or JSON
+func writeSummary(out io.Writer, format string, summary Summary) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(summary)
+	case "text":
+	default:
+		return errors.New(fmt.Sprintf("unknown summary format %s: it must be text or json", format))
+	}
+	dryRun := ""
+	if summary.DryRun {
+		dryRun = " (dry run)"
+	}
+	fmt.Fprintf(out, "summary of the run started at %s, %s long%s\n",
+		summary.Started.Format(time.RFC3339), time.Duration(summary.Duration*float64(time.Second)).Round(time.Millisecond), dryRun)
+	for _, source := range summary.Sources {
+		fmt.Fprintf(out, "source %s: %d lines\n", source.Source, source.Lines)
+	}
+	for _, rule := range summary.Rules {
+		fmt.Fprintf(out, "rule %s: %d lines matching, %d IPs\n", rule.Rule, rule.Lines, rule.IPs)
+	}
+	fmt.Fprintf(out, "IPs: %d extracted, %d whitelisted\n", summary.Extracted, summary.Whitelisted)
+	fmt.Fprintf(out, "records: %d added, %d extended, %d allowlisted, %d removed, %d expired\n",
+		summary.Added, summary.Extended, summary.Allowlisted, summary.Removed, summary.Expired)
+	fmt.Fprintf(out, "errors: %d\n", summary.Errors)
+	if len(summary.LastError) > 0 {
+		fmt.Fprintf(out, "last error: %s\n", summary.LastError)
+	}
+	return nil
+}
+
+// countAllowlisted counts the records the batch writer skipped because in
+// the allowlist, returning any other error.
+func (r *runner) countAllowlisted(err error) error {
+	if allowlisted, ok := err.(*gblist.AllowlistError); ok {
+		atomic.AddInt64(&r.stats.allowlisted, int64(len(allowlisted.IPs)))
+		return nil
+	}
+	return err
+}
+
+// logError logs an error that does not stop the run, counting it
+func (r *runner) logError(err error) {
+	r.stats.error(err)
+	log.Print(err)
+}
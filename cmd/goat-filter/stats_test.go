@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunner_Summary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Allow("192.0.2.3", "office")
+	if err != nil {
+		storage.Close()
+		t.Fatal(err)
+	}
+	cfg := Config{Sources: []string{"mail.log"}, Patterns: []string{pattern, saslPattern}, Bucket: "test", WhiteList: []string{"10.0.0.0/8"}}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		storage.Close()
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	r.writer = storage.NewBatchWriter("test", 1, 0)
+	lines := []string{
+		"postfix/smtpd[42]: lost connection after EHLO from unknown[192.0.2.1]",
+		"postfix/smtpd[42]: lost connection after EHLO from unknown[192.0.2.2]",
+		"postfix/smtpd[42]: lost connection after AUTH from unknown[192.0.2.9]",
+		"postfix/smtpd[42]: lost connection after DATA from unknown[192.0.2.1]",
+		"postfix/smtpd[42]: lost connection after EHLO from unknown[192.0.2.3]",
+		"postfix/smtpd[42]: lost connection after EHLO from unknown[10.0.0.1]",
+	}
+	for _, line := range lines {
+		err = r.process("mail.log", line)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = r.countAllowlisted(r.writer.Close())
+	}
+	r.logError(errors.New("something went wrong"))
+	storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+
+	summary := r.stats.summary(settings.Rules)
+	expected := Summary{
+		Started:  summary.Started,
+		Duration: summary.Duration,
+		Sources:  []SourceSummary{{Source: "mail.log", Lines: 6}},
+		Rules: []RuleSummary{
+			{Rule: pattern, Lines: 5, IPs: 5},
+			{Rule: saslPattern}, // Listed, though it never matched
+		},
+		Extracted:   5,
+		Whitelisted: 1,
+		Allowlisted: 1,
+		Added:       2,
+		Extended:    1,
+		Errors:      1,
+		LastError:   "something went wrong",
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("wrong summary %+v (expected %+v)", summary, expected)
+	}
+
+	var out bytes.Buffer
+	err = writeSummary(&out, "text", summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"source mail.log: 6 lines\n",
+		"rule " + pattern + ": 5 lines matching, 5 IPs\n",
+		"rule " + saslPattern + ": 0 lines matching, 0 IPs\n",
+		"IPs: 5 extracted, 1 whitelisted\n",
+		"records: 2 added, 1 extended, 1 allowlisted, 0 removed, 0 expired\n",
+		"errors: 1\n",
+		"last error: something went wrong\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q in the text summary:\n%s", line, out.String())
+		}
+	}
+
+	out.Reset()
+	err = writeSummary(&out, "json", summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Summary
+	err = json.Unmarshal(out.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Started.Equal(summary.Started) {
+		t.Errorf("wrong start time %s in the JSON summary", decoded.Started)
+	}
+	decoded.Started = summary.Started
+	if !reflect.DeepEqual(decoded, summary) {
+		t.Errorf("wrong JSON summary:\n%s", out.String())
+	}
+	for _, field := range []string{`"ips_whitelisted": 1`, `"allowlisted": 1`, `"added": 2`, `"extended": 1`, `"errors": 1`} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("missing %s in the JSON summary:\n%s", field, out.String())
+		}
+	}
+
+	err = writeSummary(&out, "xml", summary)
+	if err == nil {
+		t.Errorf("unknown summary format accepted")
+	}
+}
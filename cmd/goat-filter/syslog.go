@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMessageSize is the largest syslog message received
+const maxMessageSize = 64 * 1024
+
+// parseSyslog parses a syslog message, in RFC 5424 or RFC 3164 format (or a
+// line of a log file written by syslog, as those are the same without the
+// priority, and so the facility is unknown). Text is the content of the
+// message or, if it cannot be parsed, the whole message.
+func parseSyslog(raw string) message {
+	line := strings.TrimRight(raw, "\r\n\x00")
+	msg := message{Text: line, Facility: -1}
+	rest := line
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end > 1 && end <= 4 {
+			priority, err := strconv.Atoi(rest[1:end])
+			if err == nil && priority/8 < len(facilities) {
+				msg.Facility = priority / 8
+				rest = rest[end+1:]
+				msg.Text = rest
+			}
+		}
+	}
+	if msg.Facility >= 0 && strings.HasPrefix(rest, "1 ") {
+		parseRFC5424(rest, &msg)
+	} else {
+		parseRFC3164(rest, &msg)
+	}
+	msg.Content = msg.Text
+	return msg
+}
+
+// parseLine returns the message of a line read from a file. The patterns
+// are matched against the whole line, which is parsed as syslog would have
+// written it only if a rule needs the header (for its conditions, the JSON
+// object after it, or its description).
+func parseLine(text string, header bool) message {
+	msg := message{Content: text, Facility: -1}
+	if header {
+		msg = parseSyslog(text)
+	}
+	msg.Text = text
+	return msg
+}
+
+// parseRFC5424 parses what follows the priority of an RFC 5424 message:
+// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(rest string, msg *message) {
+	fields := strings.SplitN(rest, " ", 7)
+	if len(fields) < 7 {
+		return
+	}
+	msg.Time, _ = time.Parse(time.RFC3339Nano, fields[1])
+	msg.Hostname = nilValue(fields[2])
+	msg.Program = nilValue(fields[3])
+	data := fields[6]
+	content := ""
+	if strings.HasPrefix(data, "-") {
+		content = data[1:]
+	} else {
+		// Skip the structured data elements, minding the escaped characters
+		// and the quoted values
+		quoted, escaped, depth := false, false, 0
+		i := 0
+	parse:
+		for ; i < len(data); i++ {
+			c := data[i]
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = !quoted
+			case quoted:
+			case c == '[':
+				depth++
+			case c == ']':
+				depth--
+				if depth == 0 && (i+1 == len(data) || data[i+1] != '[') {
+					i++
+					break parse
+				}
+			}
+		}
+		content = data[i:]
+	}
+	content = strings.TrimPrefix(content, " ")
+	msg.Text = strings.TrimPrefix(content, "\ufeff") // The BOM of UTF-8 messages
+}
+
+// nilValue returns the field of an RFC 5424 header, empty for "-"
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// parseRFC3164 parses what follows the priority of an RFC 3164 message:
+// TIMESTAMP [HOSTNAME] TAG[PID]: MSG
+// where the timestamp can be in RFC 3339 format too.
+func parseRFC3164(rest string, msg *message) {
+	var timestamp time.Time
+	var err error
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		timestamp, err = stampTime(rest[:len(time.Stamp)], time.Now())
+	}
+	if err == nil && !timestamp.IsZero() {
+		rest = rest[len(time.Stamp)+1:]
+	} else {
+		space := strings.IndexByte(rest, ' ')
+		if space < 0 {
+			return
+		}
+		timestamp, err = time.Parse(time.RFC3339Nano, rest[:space])
+		if err != nil {
+			return // Not a syslog message
+		}
+		rest = rest[space+1:]
+	}
+	msg.Time = timestamp
+	fields := strings.SplitN(rest, " ", 3)
+	if !isTag(fields[0]) && len(fields) > 1 && isTag(fields[1]) {
+		msg.Hostname = fields[0]
+		fields = fields[1:]
+	}
+	if !isTag(fields[0]) {
+		msg.Text = rest
+		return
+	}
+	msg.Program = strings.TrimSuffix(fields[0], ":")
+	if i := strings.IndexByte(msg.Program, '['); i >= 0 {
+		msg.Program = msg.Program[:i]
+	}
+	msg.Text = strings.Join(fields[1:], " ")
+}
+
+// stampTime parses an RFC 3164 timestamp, like "Oct  8 22:14:15", which has
+// no year: it's the one of now, unless that makes it more than a day in the
+// future (as in a log of December read in January).
+func stampTime(text string, now time.Time) (time.Time, error) {
+	stamp, err := time.ParseInLocation(time.Stamp, text, time.Local)
+	if err != nil {
+		return stamp, err
+	}
+	year := now.Year()
+	t := time.Date(year, stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, time.Local)
+	if t.After(now.AddDate(0, 0, 1)) {
+		t = time.Date(year-1, stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, time.Local)
+	}
+	return t, nil
+}
+
+// isTag returns if the field is the tag of an RFC 3164 message (the program,
+// followed by the optional PID and a colon)
+func isTag(field string) bool {
+	return strings.HasSuffix(field, ":") && len(field) > 1
+}
+
+// listener receives syslog messages on a socket
+type listener struct {
+	address string
+	closer  io.Closer
+	done    chan struct{}
+	once    sync.Once
+}
+
+// close stops the listener
+func (l *listener) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.closer.Close()
+	})
+}
+
+// parseListener splits the address of a listener (like udp://0.0.0.0:514,
+// tcp://127.0.0.1:5514, unix:///run/goat-filter.sock or
+// unixgram:///run/goat-filter.sock) into network and address.
+func parseListener(address string) (string, string, error) {
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", errors.New(fmt.Sprintf("invalid listener %s: it must be like udp://HOST:PORT", address))
+	}
+	switch parts[0] {
+	case "udp", "tcp", "unix", "unixgram":
+		return parts[0], parts[1], nil
+	}
+	return "", "", errors.New(fmt.Sprintf("invalid listener %s: unknown network %s", address, parts[0]))
+}
+
+// listen starts receiving syslog messages at the address
+func (r *runner) listen(address string) (*listener, error) {
+	network, addr, err := parseListener(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" || network == "unixgram" {
+		// A socket left behind by a previous run
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	l := &listener{address: address, done: make(chan struct{})}
+	switch network {
+	case "udp", "unixgram":
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		l.closer = conn
+		go r.receivePackets(l, conn)
+	default:
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		l.closer = ln
+		go r.accept(l, ln)
+	}
+	return l, nil
+}
+
+// receivePackets handles the datagrams, each a message
+func (r *runner) receivePackets(l *listener, conn net.PacketConn) {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			r.logError(errors.New(fmt.Sprintf("listener %s: %s", l.address, err.Error())))
+			continue
+		}
+		r.receive(l.address, string(buffer[:n]))
+	}
+}
+
+// accept handles the connections to a stream socket
+func (r *runner) accept(l *listener, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			r.logError(errors.New(fmt.Sprintf("listener %s: %s", l.address, err.Error())))
+			time.Sleep(followInterval) // Like when out of file descriptors
+			continue
+		}
+		go r.receiveStream(l, conn)
+	}
+}
+
+// receiveStream handles the messages of a connection, either separated by
+// new lines or prefixed by their length (octet counting, RFC 6587). A
+// message longer than maxMessageSize closes the connection.
+func (r *runner) receiveStream(l *listener, conn net.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-l.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	reader := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		var raw string
+		if first[0] >= '0' && first[0] <= '9' {
+			var prefix []byte
+			prefix, err = reader.ReadSlice(' ') // Up to maxMessageSize
+			length := string(prefix)
+			var size int
+			if err == nil {
+				size, err = strconv.Atoi(strings.TrimSuffix(length, " "))
+			}
+			if err != nil || size <= 0 || size > maxMessageSize {
+				if len(length) > 16 {
+					length = length[:16] + "..."
+				}
+				r.logError(errors.New(fmt.Sprintf("listener %s: invalid message length %q", l.address, length)))
+				return
+			}
+			buffer := make([]byte, size)
+			_, err = io.ReadFull(reader, buffer)
+			raw = string(buffer)
+		} else {
+			var line []byte
+			line, err = reader.ReadSlice('\n')
+			raw = string(line)
+			if err == bufio.ErrBufferFull {
+				r.logError(errors.New(fmt.Sprintf("listener %s: message longer than %d bytes", l.address, maxMessageSize)))
+				return
+			}
+			if err == io.EOF && len(raw) > 0 {
+				err = nil
+			}
+		}
+		if err != nil {
+			return
+		}
+		r.receive(l.address, raw)
+	}
+}
+
+// receive handles a syslog message, adding what is known of its origin to
+// the metadata of the records
+func (r *runner) receive(address string, raw string) {
+	atomic.AddInt64(r.stats.source(address), 1)
+	msg := parseSyslog(raw)
+	msg.Meta = make(map[string]string)
+	if len(msg.Hostname) > 0 {
+		msg.Meta["hostname"] = msg.Hostname
+	}
+	if len(msg.Program) > 0 {
+		msg.Meta["program"] = msg.Program
+	}
+	if msg.Facility >= 0 {
+		msg.Meta["facility"] = facilities[msg.Facility]
+	}
+	err := r.handle(address, &msg)
+	if err != nil {
+		r.logError(errors.New(fmt.Sprintf("listener %s: %s", address, err.Error())))
+	}
+}
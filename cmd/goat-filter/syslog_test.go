@@ -0,0 +1,243 @@
+package main
+
+import (
+	"github.com/weregoat/gblist"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		raw      string
+		facility int
+		hostname string
+		program  string
+		text     string
+		time     string // RFC 3339, or the month and day of RFC 3164 timestamps
+	}{
+		// RFC 3164, and the lines of the files written by syslog
+		{"<22>Oct 17 10:00:00 mx postfix/smtpd[42]: connect from unknown[192.0.2.1]\n", 2, "mx", "postfix/smtpd", "connect from unknown[192.0.2.1]", "Oct 17"},
+		{"Oct  7 10:00:00 mx sshd[1]: Invalid user admin", -1, "mx", "sshd", "Invalid user admin", "Oct  7"},
+		{"<38>Oct 17 10:00:00 sshd: no hostname", 4, "", "sshd", "no hostname", "Oct 17"},
+		{"<13>2020-01-02T03:04:05Z mx su: RFC 3339 timestamp", 1, "mx", "su", "RFC 3339 timestamp", "2020-01-02T03:04:05Z"},
+		{"<13>Oct 17 10:00:00 mx no tag at all", 1, "", "", "mx no tag at all", "Oct 17"},
+		{"not syslog: at all", -1, "", "", "not syslog: at all", ""},
+		{"<999>Oct 17 10:00:00 mx sshd: priority out of range", -1, "", "", "<999>Oct 17 10:00:00 mx sshd: priority out of range", ""},
+		// RFC 5424
+		{"<34>1 2020-01-02T03:04:05.123Z mx sshd 42 ID47 - Failed password\n", 4, "mx", "sshd", "Failed password", "2020-01-02T03:04:05.123Z"},
+		{"<34>1 2020-01-02T03:04:05Z mx sshd - - [id@1 a=\"x\"][id@2 b=\"y ] \\\" z\"] Failed password", 4, "mx", "sshd", "Failed password", "2020-01-02T03:04:05Z"},
+		{"<34>1 2020-01-02T03:04:05Z - - - - [id@1 a=\"]\"]", 4, "", "", "", "2020-01-02T03:04:05Z"},
+		{"<34>1 2020-01-02T03:04:05Z mx app - - - \ufeffBOM", 4, "mx", "app", "BOM", "2020-01-02T03:04:05Z"},
+		{"<34>1 - mx app - - -", 4, "mx", "app", "", ""},
+	}
+	for _, test := range tests {
+		msg := parseSyslog(test.raw)
+		if msg.Facility != test.facility || msg.Hostname != test.hostname || msg.Program != test.program || msg.Text != test.text {
+			t.Errorf("wrong message parsed from %q: %+v", test.raw, msg)
+		}
+		if msg.Content != msg.Text {
+			t.Errorf("wrong content parsed from %q: %q", test.raw, msg.Content)
+		}
+		switch {
+		case len(test.time) == 0:
+			if !msg.Time.IsZero() {
+				t.Errorf("wrong time parsed from %q: %s", test.raw, msg.Time)
+			}
+		case strings.Contains(test.time, "T"):
+			if expected, _ := time.Parse(time.RFC3339Nano, test.time); !msg.Time.Equal(expected) {
+				t.Errorf("wrong time parsed from %q: %s", test.raw, msg.Time)
+			}
+		default:
+			if msg.Time.Format("Jan _2") != test.time {
+				t.Errorf("wrong time parsed from %q: %s", test.raw, msg.Time)
+			}
+		}
+	}
+}
+
+func TestStampTime(t *testing.T) {
+	tests := []struct {
+		stamp    string
+		now      time.Time
+		expected time.Time
+	}{
+		{"Oct  8 22:14:15", time.Date(2020, 10, 9, 0, 0, 0, 0, time.Local), time.Date(2020, 10, 8, 22, 14, 15, 0, time.Local)},
+		// A log of December read in January
+		{"Dec 31 23:59:59", time.Date(2021, 1, 1, 0, 0, 10, 0, time.Local), time.Date(2020, 12, 31, 23, 59, 59, 0, time.Local)},
+		// Up to a day in the future, as clocks differ
+		{"Jan  1 00:00:05", time.Date(2020, 12, 31, 23, 59, 59, 0, time.Local), time.Date(2020, 1, 1, 0, 0, 5, 0, time.Local)},
+		{"Oct  9 12:00:00", time.Date(2020, 10, 9, 0, 0, 0, 0, time.Local), time.Date(2020, 10, 9, 12, 0, 0, 0, time.Local)},
+		{"Oct 11 12:00:00", time.Date(2020, 10, 9, 0, 0, 0, 0, time.Local), time.Date(2019, 10, 11, 12, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		stamp, err := stampTime(test.stamp, test.now)
+		if err != nil {
+			t.Errorf("%s: %s", test.stamp, err)
+		} else if !stamp.Equal(test.expected) {
+			t.Errorf("wrong time of %q at %s: %s", test.stamp, test.now, stamp)
+		}
+	}
+	_, err := stampTime("Foo 31 25:00:00", time.Now())
+	if err == nil {
+		t.Errorf("invalid timestamp parsed")
+	}
+}
+
+func TestParseFacility(t *testing.T) {
+	tests := map[string]int{
+		"kern":   0,
+		"mail":   2,
+		"auth":   4,
+		"local7": 23,
+		"3":      3,
+		"23":     23,
+		"24":     -1,
+		"-1":     -1,
+		"mial":   -1,
+		"":       -1,
+	}
+	for name, expected := range tests {
+		if facility := parseFacility(name); facility != expected {
+			t.Errorf("wrong facility %d of %q", facility, name)
+		}
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	valid := map[string][2]string{
+		"udp://0.0.0.0:514":                {"udp", "0.0.0.0:514"},
+		"tcp://127.0.0.1:5514":             {"tcp", "127.0.0.1:5514"},
+		"unixgram:///run/goat-filter.sock": {"unixgram", "/run/goat-filter.sock"},
+	}
+	for address, expected := range valid {
+		network, addr, err := parseListener(address)
+		if err != nil || network != expected[0] || addr != expected[1] {
+			t.Errorf("wrong listener %s %s from %s (%v)", network, addr, address, err)
+		}
+	}
+	for _, address := range []string{"127.0.0.1:514", "udp://", "sctp://127.0.0.1:514"} {
+		_, _, err := parseListener(address)
+		if err == nil {
+			t.Errorf("invalid listener %s parsed", address)
+		}
+	}
+}
+
+func TestRunner_ReceiveStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{Listeners: []string{"tcp://127.0.0.1:0"}, Patterns: []string{pattern}, Bucket: "test"}
+	settings, err := compileConfig(&cfg, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner("", &settings)
+	defer r.writer.Close()
+	l, err := r.listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	address := l.closer.(net.Listener).Addr().String()
+	lines := r.stats.source(l.address)
+
+	send := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(conn, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	message := "<22>Oct 17 10:00:00 mx postfix/smtpd[42]: lost connection after EHLO from unknown[192.0.2.1]"
+	// New line and octet counting framing, mixed; the last line is ended by closing
+	conn := send(message + "\n" + strconv.Itoa(len(message)) + " " + message + message)
+	conn.Close()
+	waitFor(t, func() bool { return atomic.LoadInt64(lines) == 3 })
+
+	// A line longer than maxMessageSize closes the connection (reset, as what
+	// was sent is not read)
+	conn = send(strings.Repeat("x", maxMessageSize+1))
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Errorf("connection not closed after a line too long")
+	}
+	// So does a length prefix that never ends
+	conn = send(strings.Repeat("1", maxMessageSize+1))
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Errorf("connection not closed after a length too long")
+	}
+	if n := atomic.LoadInt64(lines); n != 3 {
+		t.Errorf("wrong number of messages received %d", n)
+	}
+}
+
+// waitFor waits up to a few seconds for the condition to be true
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out")
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		cfg    RuleConfig
+		syslog bool
+	}{
+		{RuleConfig{Pattern: pattern}, false},
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "{{.IP}} {{.Line}} {{.Groups.ip}}"}, false},
+		{RuleConfig{Pattern: pattern, Program: "^postfix/"}, true},
+		{RuleConfig{Pattern: pattern, Hostname: "^mx$"}, true},
+		{RuleConfig{Pattern: pattern, Facility: "mail"}, true},
+		{RuleConfig{Format: "json", IPField: "ip"}, true},
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "{{.IP}} at {{.Time.Unix}}"}, true},
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "{{with .Groups}}{{.ip}}{{end}} from {{$.Program}}"}, true},
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "{{if .IP}}{{.Hostname}}{{end}}"}, true},
+		{RuleConfig{Pattern: pattern, DescriptionTemplate: "{{printf \"%v\" .}}"}, true},
+	}
+	line := "Oct 17 10:00:00 mx postfix/smtpd[42]: lost connection after EHLO from unknown[192.0.2.1]"
+	for _, test := range tests {
+		rule, err := compileRule(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Syslog != test.syslog {
+			t.Errorf("wrong need of the syslog header for %+v: %t", test.cfg, rule.Syslog)
+		}
+		msg := parseLine(line, rule.Syslog)
+		if msg.Text != line || msg.Facility != -1 || (msg.Program == "postfix/smtpd") != test.syslog {
+			t.Errorf("wrong message parsed for %+v: %+v", test.cfg, msg)
+		}
+		if expected := "lost connection after EHLO from unknown[192.0.2.1]"; test.syslog && msg.Content != expected {
+			t.Errorf("wrong content parsed for %+v: %q", test.cfg, msg.Content)
+		}
+	}
+}
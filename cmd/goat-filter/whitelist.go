@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/weregoat/gblist"
+	"net"
+	"os"
+	"strings"
+)
+
+// bucketPrefix marks a whitelist entry referring to a bucket of the database
+const bucketPrefix = "bucket:"
+
+// loadWhitelist parses the entries of the whitelist, which can be:
+// a CIDR or a single IP;
+// "@" followed by the path of a file with one of them per line (the rest of
+// the line, like the hostnames in a hosts file, and "#" comments are
+// ignored; nothing is resolved);
+// "bucket:" followed by the name of a bucket of the database, whose non
+// expired records are whitelisted.
+// Files and buckets are read every time the configuration is loaded; without
+// a storage (when just checking the configuration) buckets are skipped.
+func loadWhitelist(entries []string, storage *gblist.Storage) ([]*net.IPNet, error) {
+	var whitelist []*net.IPNet
+	for _, element := range entries {
+		entry := strings.TrimSpace(element)
+		switch {
+		case len(entry) == 0:
+			continue
+		case strings.HasPrefix(entry, "@"):
+			networks, err := readWhitelist(strings.TrimSpace(entry[1:]))
+			if err != nil {
+				return nil, err
+			}
+			whitelist = append(whitelist, networks...)
+		case strings.HasPrefix(entry, bucketPrefix):
+			bucket := strings.TrimSpace(entry[len(bucketPrefix):])
+			if storage == nil {
+				continue
+			}
+			records, err := storage.Select(bucket, gblist.Filter{})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("failed to read whitelisted bucket %s: %s", bucket, err.Error()))
+			}
+			for _, record := range records {
+				network, err := gblist.ParseNetwork(record.IP)
+				if err == nil {
+					whitelist = append(whitelist, network)
+				}
+			}
+		default:
+			network, err := gblist.ParseNetwork(entry)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("failed to parse whitelisted CIDR %s: %s", entry, err.Error()))
+			}
+			whitelist = append(whitelist, network)
+		}
+	}
+	return whitelist, nil
+}
+
+// readWhitelist reads the networks from a whitelist file
+func readWhitelist(path string) ([]*net.IPNet, error) {
+	var whitelist []*net.IPNet
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read whitelist file: %s", err.Error()))
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		network, err := gblist.ParseNetwork(fields[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to parse line %d of whitelist file %s: %s", line, path, err.Error()))
+		}
+		whitelist = append(whitelist, network)
+	}
+	return whitelist, scanner.Err()
+}
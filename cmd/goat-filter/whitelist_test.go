@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/weregoat/gblist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadWhitelist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goat-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(hosts, []byte("# Our hosts\n192.0.2.10 mail.example.com mail\n\n2001:db8::/64 # office\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken")
+	err = ioutil.WriteFile(broken, []byte("192.0.2.10\nmail.example.com\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := gblist.Open(filepath.Join(dir, "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	err = storage.AddBatch("partners", []gblist.Record{
+		{IP: "203.0.113.0/24", ExpirationTime: time.Now().Add(time.Hour)},
+		{IP: "203.0.113.200", ExpirationTime: time.Now().Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whitelist, err := loadWhitelist([]string{"198.51.100.0/24", " 192.0.2.1 ", "", "@" + hosts, "bucket:partners"}, &storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"198.51.100.0/24", "192.0.2.1/32", "192.0.2.10/32", "2001:db8::/64", "203.0.113.0/24"}
+	if len(whitelist) != len(expected) {
+		t.Fatalf("wrong whitelist %v", whitelist)
+	}
+	for i, network := range whitelist {
+		if network.String() != expected[i] {
+			t.Errorf("wrong network %s (expected %s)", network, expected[i])
+		}
+	}
+
+	// Without a storage buckets are skipped; a missing one is just empty
+	whitelist, err = loadWhitelist([]string{"bucket:partners"}, nil)
+	if err != nil || len(whitelist) != 0 {
+		t.Errorf("wrong whitelist without storage %v (%v)", whitelist, err)
+	}
+	whitelist, err = loadWhitelist([]string{"bucket:missing"}, &storage)
+	if err != nil || len(whitelist) != 0 {
+		t.Errorf("wrong whitelist of a missing bucket %v (%v)", whitelist, err)
+	}
+
+	for _, entries := range [][]string{
+		{"192.0.2.300"},
+		{"@" + broken},
+		{"@" + filepath.Join(dir, "missing")},
+	} {
+		_, err = loadWhitelist(entries, &storage)
+		if err == nil {
+			t.Errorf("no error loading %v", entries)
+		}
+	}
+}
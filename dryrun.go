@@ -0,0 +1,100 @@
+package gblist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"sync"
+	"time"
+)
+
+// dryRun is a read-write transaction that is never committed, shared by all
+// the operations of a storage (and of the copies made afterwards), so that
+// each sees what the previous ones changed.
+type dryRun struct {
+	mutex   sync.Mutex
+	tx      *bolt.Tx
+	changes []Change
+}
+
+// DryRun makes all the following changes to the storage in a single
+// transaction, which is rolled back by Close: the database is left untouched.
+// Watchers are not notified (so hooks are not run); the changes are returned
+// by Changes instead.
+// Unlike real transactions, an operation failing half-way is not undone.
+func (s *Storage) DryRun() error {
+	if s.dryRun != nil {
+		return errors.New("dry run already started")
+	}
+	tx, err := s.Database.Begin(true)
+	if err == nil {
+		s.dryRun = &dryRun{tx: tx}
+	}
+	return err
+}
+
+// Changes returns the changes made since DryRun was called, oldest first.
+func (s *Storage) Changes() []Change {
+	if s.dryRun == nil {
+		return nil
+	}
+	s.dryRun.mutex.Lock()
+	defer s.dryRun.mutex.Unlock()
+	return append([]Change(nil), s.dryRun.changes...)
+}
+
+// WriteChanges writes the changes made during a dry run, one per line,
+// followed by their count.
+func WriteChanges(w io.Writer, changes []Change) error {
+	counts := make(map[ChangeType]int)
+	for _, change := range changes {
+		counts[change.Type]++
+		_, err := fmt.Fprintf(w, "would %s %s in %s (expiration time %s): %q\n",
+			change.Type.Action(), change.Record.IP, change.Bucket,
+			change.Record.ExpirationTime.Format(time.RFC3339), change.Record.Description)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "dry run: %d added, %d extended, %d removed, %d expired; nothing was written\n",
+		counts[Added], counts[Updated], counts[Removed], counts[Expired])
+	return err
+}
+
+// update runs fn in a read-write transaction, the dry run one if started.
+func (s *Storage) update(fn func(tx *bolt.Tx) error) error {
+	if s.Metrics != nil {
+		defer s.Metrics.transaction("update", time.Now())
+	}
+	if s.dryRun == nil {
+		return s.Database.Update(fn)
+	}
+	s.dryRun.mutex.Lock()
+	defer s.dryRun.mutex.Unlock()
+	return fn(s.dryRun.tx)
+}
+
+// view runs fn in a read-only transaction or, during a dry run, in the dry
+// run one.
+func (s *Storage) view(fn func(tx *bolt.Tx) error) error {
+	if s.Metrics != nil {
+		defer s.Metrics.transaction("view", time.Now())
+	}
+	if s.dryRun == nil {
+		return s.Database.View(fn)
+	}
+	s.dryRun.mutex.Lock()
+	defer s.dryRun.mutex.Unlock()
+	return fn(s.dryRun.tx)
+}
+
+// rollback discards the dry run transaction, if any.
+func (s *Storage) rollback() error {
+	if s.dryRun == nil {
+		return nil
+	}
+	s.dryRun.mutex.Lock()
+	defer s.dryRun.mutex.Unlock()
+	return s.dryRun.tx.Rollback()
+}
@@ -0,0 +1,101 @@
+package gblist
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_DryRun(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.DryRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddBatch(BUCKET, []Record{createRecord("192.0.2.2", "", ttl, t), createRecord("192.0.2.1", "", ttl, t)})
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Purge(BUCKET, "192.0.2.2")
+	if err != nil {
+		t.Error(err)
+	}
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].Hits != 2 {
+		t.Errorf("wrong records in the dry run %+v", list)
+	}
+	changes := s.Changes()
+	expected := []ChangeType{Added, Updated, Removed}
+	if len(changes) != len(expected) {
+		t.Fatalf("wrong changes %+v", changes)
+	}
+	for i, change := range changes {
+		if change.Type != expected[i] {
+			t.Errorf("wrong change %d: %s", i, change.Type)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err = Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	list, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].Hits != 1 {
+		t.Errorf("dry run changed the database %+v", list)
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteChanges(t *testing.T) {
+	expiration := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	changes := []Change{
+		{Type: Added, Bucket: BUCKET, Record: Record{IP: "192.0.2.1", ExpirationTime: expiration, Description: `a "quoted" line`}},
+		{Type: Updated, Bucket: BUCKET, Record: Record{IP: "192.0.2.1", ExpirationTime: expiration}},
+		{Type: Expired, Bucket: "other", Record: Record{IP: "2001:db8::1", ExpirationTime: expiration}},
+	}
+	var out bytes.Buffer
+	err := WriteChanges(&out, changes)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := `would add 192.0.2.1 in test (expiration time 2020-01-02T03:04:05Z): "a \"quoted\" line"
+would extend 192.0.2.1 in test (expiration time 2020-01-02T03:04:05Z): ""
+would expire 2001:db8::1 in other (expiration time 2020-01-02T03:04:05Z): ""
+dry run: 1 added, 1 extended, 0 removed, 1 expired; nothing was written
+`
+	if out.String() != expected {
+		t.Errorf("wrong changes written:\n%s", out.String())
+	}
+	for _, changeType := range ChangeTypes {
+		if changeTypes[changeType.Action()] != changeType {
+			t.Errorf("wrong action %s of %s", changeType.Action(), changeType)
+		}
+	}
+}
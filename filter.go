@@ -0,0 +1,151 @@
+package gblist
+
+import (
+	"github.com/boltdb/bolt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter selects records; the fields left to their zero value match any record.
+// Country: the ISO code of the country.
+// ASN: the autonomous system number.
+// Tags: tags the record must all have.
+// Description: a regular expression the description must match.
+// Network: the network the record (IP or CIDR) must be contained in.
+// ExpiresAfter and ExpiresBefore: the range of the expiration time.
+// Source and Rule: what created the record.
+type Filter struct {
+	Country       string
+	ASN           uint
+	Tags          []string
+	Description   *regexp.Regexp
+	Network       *net.IPNet
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	Source        string
+	Rule          string
+}
+
+// IsEmpty returns if the filter matches any record.
+func (f *Filter) IsEmpty() bool {
+	return len(f.Country) == 0 && f.ASN == 0 && len(f.Tags) == 0 &&
+		f.Description == nil && f.Network == nil &&
+		f.ExpiresAfter.IsZero() && f.ExpiresBefore.IsZero() &&
+		len(f.Source) == 0 && len(f.Rule) == 0
+}
+
+// Match returns if the record satisfies all the conditions of the filter.
+func (f *Filter) Match(record Record) bool {
+	if len(f.Country) > 0 && f.Country != record.Country {
+		return false
+	}
+	if f.ASN != 0 && f.ASN != record.ASN {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !record.HasTag(tag) {
+			return false
+		}
+	}
+	if f.Description != nil && !f.Description.MatchString(record.Description) {
+		return false
+	}
+	if f.Network != nil && !containsRecord(f.Network, record.IP) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && !record.ExpirationTime.After(f.ExpiresAfter) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !record.ExpirationTime.Before(f.ExpiresBefore) {
+		return false
+	}
+	if len(f.Source) > 0 && f.Source != record.Source {
+		return false
+	}
+	if len(f.Rule) > 0 && f.Rule != record.Rule {
+		return false
+	}
+	return true
+}
+
+// Apply returns the records matching the filter.
+func (f *Filter) Apply(records []Record) []Record {
+	var selected []Record
+	for _, record := range records {
+		if f.Match(record) {
+			selected = append(selected, record)
+		}
+	}
+	return selected
+}
+
+// Select returns the non expired records of the bucket matching the filter,
+// leaving out those in the allowlist.
+// Unlike List it does not purge anything from the database.
+func (s *Storage) Select(bucket string, filter Filter) ([]Record, error) {
+	var selected []Record
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		allowed := loadAllowlist(tx)
+		return b.ForEach(func(k, v []byte) error {
+			record, err := decodeRecord(k, v)
+			if err == nil && record.IsValid() && filter.Match(record) && !allowed.contains(record.IP) {
+				selected = append(selected, record)
+			}
+			return nil
+		})
+	})
+	return selected, err
+}
+
+// PurgeSelected removes the non expired records of the bucket matching the
+// filter, in a single transaction, and returns them.
+func (s *Storage) PurgeSelected(bucket string, filter Filter) ([]Record, error) {
+	var removed []Record
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			record, err := decodeRecord(k, v)
+			if err == nil && record.IsValid() && filter.Match(record) {
+				removed = append(removed, record)
+			}
+			return nil
+		})
+		for _, record := range removed {
+			if err == nil {
+				err = b.Delete([]byte(record.IP))
+			}
+			if err == nil {
+				err = s.logChange(tx, bucket, ActionRemove, record)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		removed = nil
+	}
+	return removed, err
+}
+
+// containsRecord returns if the IP or CIDR of a record is within the network.
+func containsRecord(network *net.IPNet, ip string) bool {
+	if !strings.Contains(ip, "/") {
+		address := net.ParseIP(ip)
+		return address != nil && network.Contains(address)
+	}
+	_, recordNetwork, err := net.ParseCIDR(ip)
+	if err != nil || !network.Contains(recordNetwork.IP) {
+		return false
+	}
+	ones, bits := recordNetwork.Mask.Size()
+	networkOnes, networkBits := network.Mask.Size()
+	return bits == networkBits && ones >= networkOnes
+}
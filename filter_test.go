@@ -0,0 +1,78 @@
+package gblist
+
+import (
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestStorage_Select(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	r1 := createRecord("192.168.1.10", "sshd: invalid user", ttl, t)
+	r1.AddTags("ssh")
+	r2 := createRecord("192.168.1.0/28", "postfix: lost connection", time.Hour, t)
+	r2.AddTags("smtp", "feed:old")
+	r3 := createRecord("10.0.0.1", "sshd: invalid user", time.Hour, t)
+	r3.AddTags("ssh", "feed:old")
+	r3.Source = "import"
+	err = s.AddBatch(BUCKET, []Record{r1, r2, r3})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	filters := map[string]Filter{
+		"tag":         {Tags: []string{"ssh"}},
+		"tags":        {Tags: []string{"ssh", "feed:old"}},
+		"description": {Description: regexp.MustCompile("^sshd")},
+		"network":     {Network: network},
+		"expiration":  {ExpiresAfter: time.Now().Add(30 * time.Minute)},
+		"source":      {Source: "import"},
+	}
+	expected := map[string]int{
+		"tag":         2,
+		"tags":        1,
+		"description": 2,
+		"network":     2,
+		"expiration":  2,
+		"source":      1,
+	}
+	for name, filter := range filters {
+		records, err := s.Select(BUCKET, filter)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(records) != expected[name] {
+			t.Errorf("wrong number of records selected by %s: %d", name, len(records))
+		}
+	}
+
+	removed, err := s.PurgeSelected(BUCKET, Filter{Tags: []string{"feed:old"}})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("wrong number of records removed %d", len(removed))
+	}
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].IP != r1.IP {
+		t.Errorf("wrong records left %+v", list)
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
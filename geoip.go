@@ -0,0 +1,80 @@
+package gblist
+
+import (
+	"net"
+	"strings"
+)
+
+// Enricher adds the country, autonomous system number and organisation of
+// the IP to records, looking them up in local MaxMind DB files (like the
+// GeoLite2 Country, City and ASN databases).
+type Enricher struct {
+	country *mmdbReader
+	asn     *mmdbReader
+}
+
+// OpenEnricher loads the country and ASN databases; either path can be empty.
+func OpenEnricher(countryPath string, asnPath string) (*Enricher, error) {
+	var err error
+	e := &Enricher{}
+	if len(countryPath) > 0 {
+		e.country, err = openMMDB(countryPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(asnPath) > 0 {
+		e.asn, err = openMMDB(asnPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Enrich sets the country, ASN and organisation of the record, when found;
+// for a CIDR the network address is looked up.
+func (e *Enricher) Enrich(record *Record) error {
+	ip := net.ParseIP(record.IP)
+	if strings.Contains(record.IP, "/") {
+		ip, _, _ = net.ParseCIDR(record.IP)
+	}
+	if ip == nil {
+		return nil
+	}
+	if e.country != nil {
+		value, err := e.country.lookup(ip)
+		if err != nil {
+			return err
+		}
+		record.Country = countryCode(value)
+	}
+	if e.asn != nil {
+		value, err := e.asn.lookup(ip)
+		if err != nil {
+			return err
+		}
+		if fields, ok := value.(map[string]interface{}); ok {
+			record.ASN = uintField(fields, "autonomous_system_number")
+			record.Organization, _ = fields["autonomous_system_organization"].(string)
+		}
+	}
+	return nil
+}
+
+// countryCode returns the ISO code of the country (or, if missing, of the
+// registered country) from the data of a GeoIP2 Country or City database.
+func countryCode(value interface{}) string {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok && len(code) > 0 {
+				return code
+			}
+		}
+	}
+	return ""
+}
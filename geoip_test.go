@@ -0,0 +1,170 @@
+package gblist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnricher(t *testing.T) {
+	const path = "test.mmdb"
+	for _, ipVersion := range []int{4, 6} {
+		err := ioutil.WriteFile(path, buildMMDB(ipVersion, "1.2.3.0/24"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enricher, err := OpenEnricher(path, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := createRecord("1.2.3.4", "", time.Hour, t)
+		err = enricher.Enrich(&record)
+		if err != nil {
+			t.Error(err)
+		}
+		if record.Country != "IT" || record.ASN != 64512 || record.Organization != "Example Org" {
+			t.Errorf("wrong enrichment with IPv%d database: %+v", ipVersion, record)
+		}
+		record = createRecord("1.2.4.0/24", "", time.Hour, t)
+		err = enricher.Enrich(&record)
+		if err != nil {
+			t.Error(err)
+		}
+		if record.Country != "" || record.ASN != 0 || record.Organization != "" {
+			t.Errorf("unexpected enrichment with IPv%d database: %+v", ipVersion, record)
+		}
+	}
+	err := os.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnricher_Malformed(t *testing.T) {
+	const path = "test.mmdb"
+	err := ioutil.WriteFile(path, buildMMDBData(4, "1.2.3.0/24", []byte{mmdbPointer << 5, 0}, 0), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enricher, err := OpenEnricher(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := createRecord("1.2.3.4", "", time.Hour, t)
+	err = enricher.Enrich(&record)
+	if err == nil {
+		t.Errorf("no error looking up a pointer to itself")
+	}
+	err = os.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMMDBReader_Decode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"pointer to itself", []byte{mmdbPointer << 5, 0}},
+		{"pointer to a pointer", []byte{mmdbPointer << 5, 2, mmdbPointer << 5, 0}},
+		{"map containing itself", []byte{mmdbMap<<5 | 1, mmdbString<<5 | 1, 'a', mmdbPointer << 5, 0}},
+		{"pointer out of the data", []byte{mmdbPointer << 5, 9}},
+		{"truncated string", []byte{mmdbString<<5 | 5, 'a'}},
+		{"truncated array", []byte{mmdbExtended<<5 | 2, mmdbArray - 7}},
+		{"huge array", []byte{mmdbExtended<<5 | 31, mmdbArray - 7, 0xff, 0xff, 0xff}},
+		{"huge map", []byte{mmdbMap<<5 | 31, 0xff, 0xff, 0xff}},
+		{"map larger than the data", []byte{mmdbMap<<5 | 2, mmdbString<<5 | 1, 'a'}},
+	}
+	for _, test := range tests {
+		_, _, err := (&mmdbReader{data: test.data}).decode(0)
+		if err == nil {
+			t.Errorf("no error decoding %s", test.name)
+		}
+		// Sizes are checked against the data before allocating anything
+		if strings.HasPrefix(test.name, "huge") && (err == nil || !strings.Contains(err.Error(), "size")) {
+			t.Errorf("wrong error decoding %s: %v", test.name, err)
+		}
+	}
+}
+
+// buildMMDB returns a MaxMind DB (with 24 bit records) containing only the
+// given IPv4 network.
+func buildMMDB(ipVersion int, cidr string) []byte {
+	// Data section: the organisation, pointed from the record that follows it
+	var data bytes.Buffer
+	writeMMDBString(&data, "Example Org")
+	offset := data.Len()
+	writeMMDBMap(&data, 3)
+	writeMMDBString(&data, "country")
+	writeMMDBMap(&data, 1)
+	writeMMDBString(&data, "iso_code")
+	writeMMDBString(&data, "IT")
+	writeMMDBString(&data, "autonomous_system_number")
+	writeMMDBUint(&data, mmdbUint32, 64512)
+	writeMMDBString(&data, "autonomous_system_organization")
+	data.Write([]byte{mmdbPointer << 5, 0})
+	return buildMMDBData(ipVersion, cidr, data.Bytes(), offset)
+}
+
+// buildMMDBData returns a MaxMind DB (with 24 bit records) containing only
+// the given IPv4 network, with the given data section and the record of the
+// network at the offset.
+func buildMMDBData(ipVersion int, cidr string, data []byte, offset int) []byte {
+	_, network, _ := net.ParseCIDR(cidr)
+	ones, _ := network.Mask.Size()
+	var bits []bool
+	if ipVersion == 6 {
+		bits = make([]bool, 96)
+	}
+	for i := 0; i < ones; i++ {
+		bits = append(bits, network.IP.To4()[i/8]&(0x80>>uint(i%8)) != 0)
+	}
+
+	var buffer bytes.Buffer
+	nodeCount := len(bits)
+	for i, bit := range bits {
+		next := i + 1
+		if next == nodeCount {
+			next = nodeCount + 16 + offset
+		}
+		left, right := nodeCount, next
+		if !bit {
+			left, right = next, nodeCount
+		}
+		buffer.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	}
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data)
+	buffer.Write(mmdbMetadataMarker)
+	writeMMDBMap(&buffer, 3)
+	writeMMDBString(&buffer, "node_count")
+	writeMMDBUint(&buffer, mmdbUint32, uint(nodeCount))
+	writeMMDBString(&buffer, "record_size")
+	writeMMDBUint(&buffer, mmdbUint16, 24)
+	writeMMDBString(&buffer, "ip_version")
+	writeMMDBUint(&buffer, mmdbUint16, uint(ipVersion))
+	return buffer.Bytes()
+}
+
+func writeMMDBString(b *bytes.Buffer, s string) {
+	if len(s) < 29 {
+		b.WriteByte(mmdbString<<5 | byte(len(s)))
+	} else {
+		b.Write([]byte{mmdbString<<5 | 29, byte(len(s) - 29)})
+	}
+	b.WriteString(s)
+}
+
+func writeMMDBMap(b *bytes.Buffer, size int) {
+	b.WriteByte(mmdbMap<<5 | byte(size))
+}
+
+func writeMMDBUint(b *bytes.Buffer, kind byte, value uint) {
+	b.WriteByte(kind<<5 | 4)
+	b.Write([]byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)})
+}
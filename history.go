@@ -0,0 +1,153 @@
+package gblist
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+// Actions recorded in the history.
+const (
+	ActionAdd    = "add"    // A new record
+	ActionExtend = "extend" // A record replacing a non expired one
+	ActionRemove = "remove" // A record removed before its expiration time
+	ActionExpire = "expire" // An expired record being purged
+)
+
+// Default retention limits of the history of each bucket.
+const (
+	DefaultHistoryMaxAge    = 365 * 24 * time.Hour
+	DefaultHistoryMaxEvents = 100000
+)
+
+// historyBucket is the name of the bucket containing the history of each
+// bucket (as a nested bucket with the same name).
+const historyBucket = "_history"
+
+// Event is an entry of the append-only history of a bucket.
+// Time: when it happened.
+// Action: one of the Action constants.
+// Actor: who did it (see Storage.Actor).
+// IP, ExpirationTime and Description: those of the record.
+type Event struct {
+	Time           time.Time
+	Action         string
+	Actor          string
+	IP             string
+	ExpirationTime time.Time
+	Description    string
+}
+
+func newEvent(action string, actor string, record Record) Event {
+	return Event{
+		Time:           time.Now(),
+		Action:         action,
+		Actor:          actor,
+		IP:             record.IP,
+		ExpirationTime: record.ExpirationTime,
+		Description:    record.Description,
+	}
+}
+
+// History returns the events of the given bucket concerning the given IP,
+// oldest first; with an empty IP all of them are returned.
+func (s *Storage) History(bucket string, ip string) ([]Event, error) {
+	var events []Event
+	err := s.view(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte(historyBucket))
+		if history == nil {
+			return nil
+		}
+		b := history.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var event Event
+			err := json.Unmarshal(v, &event)
+			if err == nil && (len(ip) == 0 || event.IP == ip) {
+				events = append(events, event)
+			}
+			return nil
+		})
+	})
+	return events, err
+}
+
+// PruneHistory removes from the history of the bucket the events beyond the
+// retention limits. It's done automatically on every change; this is for
+// when the limits are changed.
+func (s *Storage) PruneHistory(bucket string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte(historyBucket))
+		if history == nil {
+			return nil
+		}
+		b := history.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return s.pruneHistory(b)
+	})
+}
+
+// appendHistory adds the event to the history of the bucket, within the given transaction.
+func (s *Storage) appendHistory(tx *bolt.Tx, bucket string, event Event) error {
+	history, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+	if err != nil {
+		return err
+	}
+	b, err := history.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	sequence, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	err = b.Put(historyKey(sequence), payload)
+	if err == nil {
+		err = s.pruneHistory(b)
+	}
+	return err
+}
+
+// pruneHistory deletes the oldest events beyond the retention limits.
+// Keys are sequential and events are only removed from the start, so the
+// number of events is the difference between the last and first key.
+func (s *Storage) pruneHistory(b *bolt.Bucket) error {
+	cutoff := time.Now().Add(-s.HistoryMaxAge)
+	last := b.Sequence()
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		expired := false
+		if s.HistoryMaxEvents > 0 && last-binary.BigEndian.Uint64(k) >= uint64(s.HistoryMaxEvents) {
+			expired = true
+		} else if s.HistoryMaxAge > 0 {
+			var event Event
+			if json.Unmarshal(v, &event) == nil {
+				expired = event.Time.Before(cutoff)
+			}
+		}
+		if !expired {
+			break
+		}
+		err := c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyKey returns the key of the event with the given sequence number
+func historyKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
@@ -0,0 +1,77 @@
+package gblist
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_History(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	s.Actor = "test"
+
+	r1 := createRecord("10.55.11.12", "first", ttl, t)
+	r2 := createRecord("127.0.0.1", "", time.Duration(1), t)
+	for _, record := range []Record{r1, r1, r2} {
+		err = s.Add(BUCKET, record)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = s.Purge(BUCKET, r1.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Duration(5))
+	_, err = s.List(BUCKET) // Expires r2
+	if err != nil {
+		t.Error(err)
+	}
+
+	events, err := s.History(BUCKET, r1.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	actions := []string{ActionAdd, ActionExtend, ActionRemove}
+	if len(events) != len(actions) {
+		t.Fatalf("wrong number of events %d", len(events))
+	}
+	for i, event := range events {
+		if event.Action != actions[i] || event.Actor != "test" || event.Description != "first" {
+			t.Errorf("wrong event %+v", event)
+		}
+	}
+	events, err = s.History(BUCKET, r2.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 2 || events[1].Action != ActionExpire {
+		t.Errorf("missing expire event %+v", events)
+	}
+
+	// Only the most recent events are kept
+	s.HistoryMaxEvents = 2
+	err = s.PruneHistory(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	events, err = s.History(BUCKET, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 2 || events[1].Action != ActionExpire {
+		t.Errorf("wrong events after pruning %+v", events)
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,188 @@
+package gblist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Defaults for the hooks
+const (
+	DefaultHookTimeout     = 30 * time.Second
+	DefaultHookConcurrency = 4
+)
+
+// Hooks run external commands when records are banned (added or extended)
+// or unbanned (removed or expired).
+// The commands are Go templates rendered with the fields of the record, the
+// type of change as Event ("added", "updated", "removed" or "expired") and
+// the Bucket, and run with "/bin/sh -c". The same values are available to
+// the command as GBLIST_* environment variables, which are safer to use for
+// anything coming from logs (like the description); otherwise use the
+// "quote" template function.
+type Hooks struct {
+	onBan       *template.Template
+	onUnban     *template.Template
+	timeout     time.Duration
+	concurrency chan struct{}
+	running     sync.WaitGroup
+}
+
+// hookData is what the hook templates are rendered with.
+type hookData struct {
+	Record
+	Event  string
+	Bucket string
+	TTL    time.Duration
+}
+
+// NewHooks parses the command templates (either can be empty) and returns
+// the hooks; a zero timeout or concurrency means the default.
+func NewHooks(onBan string, onUnban string, timeout time.Duration, concurrency int) (*Hooks, error) {
+	var err error
+	h := &Hooks{
+		timeout: timeout,
+	}
+	if h.timeout <= 0 {
+		h.timeout = DefaultHookTimeout
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultHookConcurrency
+	}
+	h.concurrency = make(chan struct{}, concurrency)
+	h.onBan, err = parseHook("on_ban", onBan)
+	if err == nil {
+		h.onUnban, err = parseHook("on_unban", onUnban)
+	}
+	return h, err
+}
+
+// parseHook parses the template of a hook command
+func parseHook(name string, command string) (*template.Template, error) {
+	if len(strings.TrimSpace(command)) == 0 {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"quote": shellQuote}).Parse(command)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("failed to parse %s hook: %s", name, err.Error()))
+	}
+	return tmpl, err
+}
+
+// Start runs the hooks for the changes to the given bucket (all of them, if
+// empty) until the storage is closed.
+func (h *Hooks) Start(s *Storage, bucket string) {
+	changes := s.Watch(bucket)
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		for change := range changes {
+			h.Run(change)
+		}
+	}()
+}
+
+// Wait waits for the hooks to complete; it should be called after closing the storage.
+func (h *Hooks) Wait() {
+	h.running.Wait()
+}
+
+// Run starts the hook for the change, if there is one, waiting if too many
+// are running already.
+func (h *Hooks) Run(change Change) {
+	tmpl, command, data, err := h.render(change)
+	if tmpl == nil {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to render %s hook for %s: %s", tmpl.Name(), data.IP, err.Error())
+		return
+	}
+	h.concurrency <- struct{}{}
+	h.running.Add(1)
+	go func() {
+		defer func() {
+			<-h.concurrency
+			h.running.Done()
+		}()
+		err := h.exec(command, data)
+		if err != nil {
+			log.Printf("%s hook for %s failed: %s", tmpl.Name(), data.IP, err.Error())
+		}
+	}()
+}
+
+// Check renders the commands for banning and unbanning the record, without
+// running them, returning the first error.
+func (h *Hooks) Check(record Record) error {
+	for _, changeType := range []ChangeType{Added, Removed} {
+		tmpl, _, _, err := h.render(Change{Type: changeType, Record: record})
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to render %s hook: %s", tmpl.Name(), err.Error()))
+		}
+	}
+	return nil
+}
+
+// render returns the template of the hook for the change (nil if there is
+// none) and the command rendered with it.
+func (h *Hooks) render(change Change) (*template.Template, string, hookData, error) {
+	tmpl := h.onBan
+	if change.Type == Removed || change.Type == Expired {
+		tmpl = h.onUnban
+	}
+	data := hookData{
+		Record: change.Record,
+		Event:  change.Type.String(),
+		Bucket: change.Bucket,
+		TTL:    time.Until(change.Record.ExpirationTime),
+	}
+	if data.TTL < 0 {
+		data.TTL = 0
+	}
+	if tmpl == nil {
+		return nil, "", data, nil
+	}
+	var command bytes.Buffer
+	err := tmpl.Execute(&command, data)
+	return tmpl, command.String(), data, err
+}
+
+// exec runs the command line with the environment variables of the record
+func (h *Hooks) exec(command string, data hookData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"GBLIST_EVENT="+data.Event,
+		"GBLIST_BUCKET="+data.Bucket,
+		"GBLIST_IP="+data.IP,
+		"GBLIST_EXPIRATION_TIME="+data.ExpirationTime.Format(time.RFC3339),
+		fmt.Sprintf("GBLIST_TTL=%d", int64(data.TTL/time.Second)),
+		"GBLIST_DESCRIPTION="+data.Description,
+		"GBLIST_SOURCE="+data.Source,
+		"GBLIST_RULE="+data.Rule,
+		fmt.Sprintf("GBLIST_HITS=%d", data.Hits),
+		"GBLIST_TAGS="+strings.Join(data.Tags, ","),
+	)
+	cmd.Stdout = os.Stderr // Not to mix with whatever the caller prints
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("timed out after %s", h.timeout))
+	}
+	return err
+}
+
+// shellQuote quotes a string for the shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,63 @@
+package gblist
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	const output = "hooks.txt"
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	hooks, err := NewHooks(
+		"echo {{.Event}} {{.IP}} {{quote .Description}} >> "+output,
+		"echo $GBLIST_EVENT $GBLIST_IP >> "+output,
+		time.Second, 1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := NewHooks("echo {{.Missing}}", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken.Check(createRecord("10.55.11.12", "", ttl, t)) == nil {
+		t.Errorf("hook referring to a missing field passed the check")
+	}
+	hooks.Start(&s, BUCKET)
+
+	record := createRecord("10.55.11.12", "it's; rm -rf /", ttl, t)
+	err = s.Add(BUCKET, record)
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Purge(BUCKET, record.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	s.Close()
+	hooks.Wait()
+
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "added 10.55.11.12 it's; rm -rf /\nremoved 10.55.11.12\n"
+	if string(content) != expected {
+		t.Errorf("wrong hooks output %q", strings.TrimSpace(string(content)))
+	}
+	os.Remove(output)
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,322 @@
+package gblist
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Formats of the lists the Importer can parse.
+const (
+	FormatPlain    = "plain"    // One IP or CIDR per line, with "#" comments
+	FormatSpamhaus = "spamhaus" // Spamhaus DROP/EDROP: "1.2.3.0/24 ; SBL123"
+	FormatNetset   = "netset"   // FireHOL .netset files
+	FormatDShield  = "dshield"  // DShield block list: start, end and netblock size, tab separated
+	FormatCSV      = "csv"      // CSV with configurable columns
+	FormatJSON     = "json"     // gblist JSON export (array or one object per line)
+)
+
+// Importer loads third-party lists into a bucket.
+// Format: one of the Format constants (plain if empty).
+// TTL: the time to live of the imported records (records from a JSON export
+// keep their expiration time, if they have one).
+// Description: the description for records that don't carry one.
+// Source and Tags: set on all the imported records (unless a JSON export
+// carries its own source).
+// Enricher: if not nil, used to add the origin of the IPs to the records.
+// Comma, IPColumn, DescriptionColumn and Header are for the CSV format only;
+// columns start from 1 (IPColumn defaults to 1, a zero DescriptionColumn
+// means no description) and Header skips the first line.
+type Importer struct {
+	Format            string
+	TTL               time.Duration
+	Description       string
+	Source            string
+	Tags              []string
+	Enricher          *Enricher
+	Comma             rune
+	IPColumn          int
+	DescriptionColumn int
+	Header            bool
+}
+
+// ImportResult reports the outcome of an import.
+// Accepted: records written to the bucket.
+// Rejected: entries that could not be parsed, already expired or in the allowlist.
+// Duplicates: entries repeated in the list (only the first is used) or
+// already listed in the bucket (they are replaced anyway).
+type ImportResult struct {
+	Accepted   int
+	Rejected   int
+	Duplicates int
+}
+
+// dumpedRecord is a record as exported by gblist
+type dumpedRecord struct {
+	IP             string            `json:"ip"`
+	ExpirationTime time.Time         `json:"expiration_time"`
+	Description    string            `json:"description"`
+	Country        string            `json:"country"`
+	ASN            uint              `json:"asn"`
+	Organization   string            `json:"organization"`
+	Source         string            `json:"source"`
+	Rule           string            `json:"rule"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	Hits           int               `json:"hits"`
+	Tags           []string          `json:"tags"`
+	Meta           map[string]string `json:"meta"`
+}
+
+// Import parses the list from the reader and adds its entries to the bucket
+// in a single transaction. Nothing is written if reading the list fails.
+func (i *Importer) Import(s *Storage, bucket string, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	records, err := i.Parse(r, &result)
+	if err != nil {
+		return result, err
+	}
+	skipped := 0
+	err = s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		allowed := loadAllowlist(tx)
+		for _, record := range records {
+			if allowed.contains(record.IP) {
+				skipped++
+				continue
+			}
+			var extended bool
+			extended, err = s.put(tx, bucket, b, record, allowed)
+			if err != nil {
+				return err
+			}
+			if extended {
+				result.Duplicates++
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		result.Accepted = len(records) - skipped
+		result.Rejected += skipped
+	}
+	return result, err
+}
+
+// Parse reads the list and returns the valid records in it, updating the
+// rejected and duplicate counts of the result.
+func (i *Importer) Parse(r io.Reader, result *ImportResult) ([]Record, error) {
+	var records []Record
+	seen := make(map[string]bool)
+	// The entry is a partial record, as found in the list
+	add := func(entry Record) {
+		description := entry.Description
+		if len(strings.TrimSpace(description)) == 0 {
+			description = i.Description
+		}
+		record, err := New(entry.IP, i.TTL, description)
+		if err != nil {
+			result.Rejected++
+			return
+		}
+		if !entry.ExpirationTime.IsZero() {
+			record.ExpirationTime = entry.ExpirationTime
+		}
+		record.Country = entry.Country
+		record.ASN = entry.ASN
+		record.Organization = entry.Organization
+		record.Source = i.Source
+		if len(entry.Source) > 0 {
+			record.Source = entry.Source
+		}
+		record.Rule = entry.Rule
+		if !entry.CreatedAt.IsZero() {
+			record.CreatedAt = entry.CreatedAt
+		}
+		if !entry.UpdatedAt.IsZero() {
+			record.UpdatedAt = entry.UpdatedAt
+		}
+		if entry.Hits > 0 {
+			record.Hits = entry.Hits
+		}
+		record.AddTags(entry.Tags...)
+		record.AddTags(i.Tags...)
+		record.Meta = entry.Meta
+		if !record.IsValid() {
+			result.Rejected++
+			return
+		}
+		if seen[record.IP] {
+			result.Duplicates++
+			return
+		}
+		if i.Enricher != nil && len(record.Country) == 0 && record.ASN == 0 {
+			i.Enricher.Enrich(&record) // Not having the origin is no reason to reject it
+		}
+		seen[record.IP] = true
+		records = append(records, record)
+	}
+	var err error
+	switch i.Format {
+	case "", FormatPlain, FormatNetset, FormatSpamhaus, FormatDShield:
+		err = i.parseLines(r, add, result)
+	case FormatCSV:
+		err = i.parseCSV(r, add, result)
+	case FormatJSON:
+		err = parseJSON(r, add)
+	default:
+		err = errors.New(fmt.Sprintf("unknown import format %s", i.Format))
+	}
+	return records, err
+}
+
+// parseLines parses the line based formats
+func (i *Importer) parseLines(r io.Reader, add func(Record), result *ImportResult) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var ip, description string
+		switch i.Format {
+		case FormatSpamhaus:
+			line, description = splitComment(line, ";")
+			ip = line
+		case FormatDShield:
+			line, _ = splitComment(line, "#")
+			fields := strings.Split(line, "\t")
+			if len(line) == 0 || fields[0] == "Start" { // Header
+				continue
+			}
+			if len(fields) < 3 {
+				result.Rejected++
+				continue
+			}
+			ip = fmt.Sprintf("%s/%s", strings.TrimSpace(fields[0]), strings.TrimSpace(fields[2]))
+			if len(fields) > 4 {
+				description = strings.TrimSpace(fields[4])
+			}
+		default:
+			line, description = splitComment(line, "#")
+			ip = line
+		}
+		if len(ip) > 0 {
+			add(Record{IP: ip, Description: description})
+		}
+	}
+	return scanner.Err()
+}
+
+// parseCSV parses CSV lists with the configured columns
+func (i *Importer) parseCSV(r io.Reader, add func(Record), result *ImportResult) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	if i.Comma != 0 {
+		reader.Comma = i.Comma
+	}
+	ipColumn := i.IPColumn
+	if ipColumn <= 0 {
+		ipColumn = 1
+	}
+	first := true
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				result.Rejected++
+				continue
+			}
+			return err
+		}
+		if first && i.Header {
+			first = false
+			continue
+		}
+		first = false
+		if len(fields) < ipColumn {
+			result.Rejected++
+			continue
+		}
+		var description string
+		if i.DescriptionColumn > 0 && len(fields) >= i.DescriptionColumn {
+			description = fields[i.DescriptionColumn-1]
+		}
+		add(Record{IP: strings.TrimSpace(fields[ipColumn-1]), Description: description})
+	}
+	return nil
+}
+
+// parseJSON parses a gblist JSON export, either as an array or as one
+// object per line.
+func parseJSON(r io.Reader, add func(Record)) error {
+	reader := bufio.NewReader(r)
+	var first byte
+	var err error
+	for {
+		first, err = reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(first)) {
+			break
+		}
+	}
+	reader.UnreadByte()
+	decoder := json.NewDecoder(reader)
+	array := first == '['
+	if array {
+		_, err = decoder.Token() // Opening bracket
+		if err != nil {
+			return err
+		}
+	}
+	for decoder.More() {
+		var record dumpedRecord
+		err = decoder.Decode(&record)
+		if err != nil {
+			return err
+		}
+		add(Record{
+			IP:             record.IP,
+			ExpirationTime: record.ExpirationTime,
+			Description:    record.Description,
+			Country:        record.Country,
+			ASN:            record.ASN,
+			Organization:   record.Organization,
+			Source:         record.Source,
+			Rule:           record.Rule,
+			CreatedAt:      record.CreatedAt,
+			UpdatedAt:      record.UpdatedAt,
+			Hits:           record.Hits,
+			Tags:           record.Tags,
+			Meta:           record.Meta,
+		})
+	}
+	if array {
+		_, err = decoder.Token() // Closing bracket
+	}
+	return err
+}
+
+// splitComment splits a line at the comment delimiter
+func splitComment(line string, delimiter string) (string, string) {
+	index := strings.Index(line, delimiter)
+	if index < 0 {
+		return line, ""
+	}
+	return strings.TrimSpace(line[:index]), strings.TrimSpace(line[index+len(delimiter):])
+}
@@ -0,0 +1,85 @@
+package gblist
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImporter_Import(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+
+	drop := "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n1.19.0.0/16 ; SBL434604\n1.10.16.0/20 ; SBL256894\nnot-an-ip ; SBL1\n"
+	importer := Importer{Format: FormatSpamhaus, TTL: ttl}
+	result, err := importer.Import(&s, BUCKET, strings.NewReader(drop))
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Accepted != 2 || result.Rejected != 1 || result.Duplicates != 1 {
+		t.Errorf("wrong import result %+v", result)
+	}
+	record, err := s.Fetch(BUCKET, "1.10.16.0/20")
+	if err != nil {
+		t.Error(err)
+	}
+	if record.Description != "SBL256894" {
+		t.Errorf("wrong description %q", record.Description)
+	}
+
+	// Already listed records are counted as duplicates
+	dshield := "#   Start\tEnd\tNetblock\tAttacks\tName\n1.19.0.0\t1.19.255.255\t16\t42\tExample\n"
+	importer = Importer{Format: FormatDShield, TTL: ttl}
+	result, err = importer.Import(&s, BUCKET, strings.NewReader(dshield))
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Accepted != 1 || result.Duplicates != 1 {
+		t.Errorf("wrong import result %+v", result)
+	}
+
+	csv := "address;note\n10.0.0.1;first\n10.0.0.2;second\n"
+	importer = Importer{Format: FormatCSV, TTL: ttl, Comma: ';', Header: true, DescriptionColumn: 2}
+	result, err = importer.Import(&s, BUCKET, strings.NewReader(csv))
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Accepted != 2 || result.Rejected != 0 {
+		t.Errorf("wrong import result %+v", result)
+	}
+
+	expiration := time.Now().Add(time.Hour).Format(time.RFC3339)
+	export := `[{"ip": "192.0.2.1", "expiration_time": "` + expiration + `", "description": "exported"}]`
+	importer = Importer{Format: FormatJSON, TTL: ttl}
+	result, err = importer.Import(&s, BUCKET, strings.NewReader(export))
+	if err != nil {
+		t.Error(err)
+	}
+	record, err = s.Fetch(BUCKET, "192.0.2.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if record.ExpirationTime.Format(time.RFC3339) != expiration {
+		t.Errorf("expiration time not imported: %s", record.ExpirationTime)
+	}
+
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 5 {
+		t.Errorf("wrong number of elements %d", len(list))
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,263 @@
+package gblist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transactionBuckets are the upper bounds, in seconds, of the buckets of the
+// transaction latency histogram.
+var transactionBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics counts what a storage does, for monitoring: the changes to the
+// buckets, the lookups (Fetch) finding a listed record or not, and how
+// long the transactions take. It's safe for concurrent use, and can be
+// shared by storages opened one after another.
+type Metrics struct {
+	mutex        sync.Mutex
+	changes      map[string]map[ChangeType]uint64 // By bucket
+	hits         map[string]uint64
+	misses       map[string]uint64
+	transactions map[string]*histogram // By type: update or view
+}
+
+// histogram counts observations in buckets, Prometheus style
+type histogram struct {
+	counts []uint64 // Not cumulative, one more than the bounds for +Inf
+	sum    float64
+	count  uint64
+}
+
+// Metric is a metric family in the Prometheus text format.
+// Type: counter, gauge or histogram.
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Sample is a sample of a metric; Suffix is appended to the name of the
+// metric (like _bucket, _sum and _count for histograms).
+type Sample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// NewMetrics returns the metrics to set in Storage.Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		changes:      make(map[string]map[ChangeType]uint64),
+		hits:         make(map[string]uint64),
+		misses:       make(map[string]uint64),
+		transactions: make(map[string]*histogram),
+	}
+}
+
+// change counts a committed change
+func (m *Metrics) change(bucket string, changeType ChangeType) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.changes[bucket] == nil {
+		m.changes[bucket] = make(map[ChangeType]uint64)
+	}
+	m.changes[bucket][changeType]++
+}
+
+// lookup counts a lookup of a record
+func (m *Metrics) lookup(bucket string, hit bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if hit {
+		m.hits[bucket]++
+	} else {
+		m.misses[bucket]++
+	}
+}
+
+// transaction records how long a transaction started at the given time took
+func (m *Metrics) transaction(kind string, started time.Time) {
+	duration := time.Since(started)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.transactions[kind]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(transactionBuckets)+1)}
+		m.transactions[kind] = h
+	}
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(transactionBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// metrics returns the metric families of the counters
+func (m *Metrics) metrics() []Metric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	changes := Metric{Name: "gblist_changes_total", Help: "Records added, extended, removed and expired, by bucket.", Type: "counter"}
+	for _, bucket := range sortedKeys(m.changes) {
+		for _, changeType := range ChangeTypes {
+			changes.Samples = append(changes.Samples, Sample{
+				Labels: map[string]string{"bucket": bucket, "action": changeType.Action()},
+				Value:  float64(m.changes[bucket][changeType]),
+			})
+		}
+	}
+	sort.SliceStable(changes.Samples, func(i, j int) bool {
+		a, b := changes.Samples[i].Labels, changes.Samples[j].Labels
+		return a["bucket"] < b["bucket"] || (a["bucket"] == b["bucket"] && a["action"] < b["action"])
+	})
+	lookups := Metric{Name: "gblist_lookups_total", Help: "Lookups of an IP, by bucket and whether it was listed.", Type: "counter"}
+	buckets := make(map[string]bool)
+	for bucket := range m.hits {
+		buckets[bucket] = true
+	}
+	for bucket := range m.misses {
+		buckets[bucket] = true
+	}
+	for _, bucket := range sortedKeys(buckets) {
+		lookups.Samples = append(lookups.Samples,
+			Sample{Labels: map[string]string{"bucket": bucket, "result": "hit"}, Value: float64(m.hits[bucket])},
+			Sample{Labels: map[string]string{"bucket": bucket, "result": "miss"}, Value: float64(m.misses[bucket])})
+	}
+	transactions := Metric{Name: "gblist_transaction_duration_seconds", Help: "Duration of the Bolt DB transactions, by type.", Type: "histogram"}
+	for _, kind := range sortedKeys(m.transactions) {
+		h := m.transactions[kind]
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(transactionBuckets) {
+				le = strconv.FormatFloat(transactionBuckets[i], 'g', -1, 64)
+			}
+			transactions.Samples = append(transactions.Samples, Sample{
+				Suffix: "_bucket",
+				Labels: map[string]string{"type": kind, "le": le},
+				Value:  float64(cumulative),
+			})
+		}
+		transactions.Samples = append(transactions.Samples,
+			Sample{Suffix: "_sum", Labels: map[string]string{"type": kind}, Value: h.sum},
+			Sample{Suffix: "_count", Labels: map[string]string{"type": kind}, Value: float64(h.count)})
+	}
+	return []Metric{changes, lookups, transactions}
+}
+
+// WriteMetrics writes the number of active records of every bucket, by IP
+// version, and the counters of Metrics (if set) in the Prometheus text
+// format. Counting the records reads the whole database.
+func (s *Storage) WriteMetrics(w io.Writer) error {
+	names, err := s.Buckets()
+	if err != nil {
+		return err
+	}
+	records := Metric{Name: "gblist_records", Help: "Active records, by bucket and IP version.", Type: "gauge"}
+	expired := Metric{Name: "gblist_expired_records", Help: "Expired records not purged yet, by bucket.", Type: "gauge"}
+	for _, name := range names {
+		stats, err := s.Stats(name)
+		if err != nil {
+			return err
+		}
+		records.Samples = append(records.Samples,
+			Sample{Labels: map[string]string{"bucket": name, "version": "4"}, Value: float64(stats.IPv4)},
+			Sample{Labels: map[string]string{"bucket": name, "version": "6"}, Value: float64(stats.IPv6)})
+		expired.Samples = append(expired.Samples, Sample{Labels: map[string]string{"bucket": name}, Value: float64(stats.Expired)})
+	}
+	metrics := []Metric{records, expired}
+	if s.Metrics != nil {
+		metrics = append(metrics, s.Metrics.metrics()...)
+	}
+	return WritePrometheus(w, metrics...)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func WritePrometheus(w io.Writer, metrics ...Metric) error {
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.Name, escapeHelp(metric.Help), metric.Name, metric.Type)
+		if err != nil {
+			return err
+		}
+		for _, sample := range metric.Samples {
+			_, err = fmt.Fprintf(w, "%s%s%s %s\n", metric.Name, sample.Suffix, formatLabels(sample.Labels), formatValue(sample.Value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MetricsHandler returns a handler serving the metrics written by the given
+// functions (like Storage.WriteMetrics), one after the other.
+func MetricsHandler(writers ...func(w io.Writer) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buffer bytes.Buffer
+		for _, write := range writers {
+			err := write(&buffer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buffer.Bytes())
+	})
+}
+
+// formatLabels formats the labels, sorted by name, as {name="value",...}
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for _, name := range sortedKeys(labels) {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[name])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeHelp escapes the help text of a metric
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// formatValue formats the value of a sample
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]bool:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]map[ChangeType]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package gblist
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_WriteMetrics(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Metrics = NewMetrics()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"} {
+		err = s.Add(BUCKET, createRecord(ip, "", ttl, t))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Purge(BUCKET, "192.0.2.2")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "198.51.100.1"} {
+		_, err = s.Fetch(BUCKET, ip)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	server := httptest.NewServer(MetricsHandler(s.WriteMetrics))
+	defer server.Close()
+	response, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("wrong content type %s", response.Header.Get("Content-Type"))
+	}
+	metrics := string(body)
+	expected := []string{
+		"# TYPE gblist_records gauge",
+		`gblist_records{bucket="test",version="4"} 1`,
+		`gblist_records{bucket="test",version="6"} 1`,
+		`gblist_expired_records{bucket="test"} 0`,
+		"# TYPE gblist_changes_total counter",
+		`gblist_changes_total{action="add",bucket="test"} 3`,
+		`gblist_changes_total{action="extend",bucket="test"} 1`,
+		`gblist_changes_total{action="remove",bucket="test"} 1`,
+		`gblist_changes_total{action="expire",bucket="test"} 0`,
+		`gblist_lookups_total{bucket="test",result="hit"} 1`,
+		`gblist_lookups_total{bucket="test",result="miss"} 2`,
+		"# TYPE gblist_transaction_duration_seconds histogram",
+		`gblist_transaction_duration_seconds_bucket{le="+Inf",type="update"} 5`,
+		`gblist_transaction_duration_seconds_count{type="update"} 5`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, metrics)
+		}
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,305 @@
+package gblist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbReader is a minimal reader of MaxMind DB files (like the GeoLite2
+// databases); see https://maxmind.github.io/MaxMind-DB/
+// The file is loaded in memory.
+type mmdbReader struct {
+	buffer     []byte
+	data       []byte // The data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // The node where the IPv4 addresses start, in IPv6 databases
+}
+
+// openMMDB loads a MaxMind DB file
+func openMMDB(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMMDBReader(buffer)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+	}
+	return r, err
+}
+
+// newMMDBReader parses the metadata of the database in the buffer
+func newMMDBReader(buffer []byte) (*mmdbReader, error) {
+	index := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metadata := buffer[index+len(mmdbMetadataMarker):]
+	value, _, err := (&mmdbReader{data: metadata}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata")
+	}
+	r := &mmdbReader{
+		buffer:     buffer,
+		nodeCount:  uintField(fields, "node_count"),
+		recordSize: uintField(fields, "record_size"),
+		ipVersion:  uintField(fields, "ip_version"),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.New(fmt.Sprintf("unsupported MaxMind DB record size %d", r.recordSize))
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(index) {
+		return nil, errors.New("invalid MaxMind DB search tree")
+	}
+	r.data = buffer[treeSize+16 : index]
+	if r.ipVersion == 6 {
+		// IPv4 addresses are in the ::/96 network
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node, _ = r.readNode(node)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// lookup returns the data for the IP, or nil if there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil // IPv6 address in an IPv4 database
+	}
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		left, right := r.readNode(node)
+		if ip[i/8]&(0x80>>uint(i%8)) == 0 {
+			node = left
+		} else {
+			node = right
+		}
+	}
+	if node == r.nodeCount {
+		return nil, nil // Not found
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid MaxMind DB search tree")
+	}
+	offset := node - r.nodeCount - 16
+	value, _, err := r.decode(offset)
+	return value, err
+}
+
+// readNode returns the left and right records of a node of the search tree
+func (r *mmdbReader) readNode(node uint) (uint, uint) {
+	size := r.recordSize / 4
+	b := r.buffer[node*size : (node+1)*size]
+	switch r.recordSize {
+	case 24:
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		left := uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		right := uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+		return left, right
+	default:
+		return uint(binary.BigEndian.Uint32(b[0:4])), uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// Types of the data section
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// mmdbMaxDepth is how deeply maps, arrays and pointers can be nested in the
+// data section, so that a corrupt file pointing back to itself fails
+// instead of recursing forever.
+const mmdbMaxDepth = 512
+
+// decode decodes the value at the offset of the data section, returning
+// the offset following it.
+func (r *mmdbReader) decode(offset uint) (interface{}, uint, error) {
+	return r.decodeAt(offset, 0)
+}
+
+// decodeAt decodes the value at the offset, nested at the given depth
+func (r *mmdbReader) decodeAt(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("invalid MaxMind DB data: nested too deeply")
+	}
+	if offset >= uint(len(r.data)) {
+		return nil, 0, errors.New("invalid MaxMind DB data offset")
+	}
+	control := r.data[offset]
+	offset++
+	kind := uint(control >> 5)
+	if kind == mmdbPointer {
+		pointer, next, err := r.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A pointer never points to another pointer
+		if pointer < uint(len(r.data)) && uint(r.data[pointer]>>5) == mmdbPointer {
+			return nil, 0, errors.New("invalid MaxMind DB pointer to a pointer")
+		}
+		value, _, err := r.decodeAt(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(r.data)) {
+			return nil, 0, errors.New("invalid MaxMind DB data")
+		}
+		kind = 7 + uint(r.data[offset])
+		offset++
+	}
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		n := size - 28 // Bytes of the size
+		if offset+n > uint(len(r.data)) {
+			return nil, 0, errors.New("invalid MaxMind DB data")
+		}
+		extra := uint(0)
+		for _, b := range r.data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	// Every element takes at least a byte (its control byte), and every
+	// entry of a map two: larger sizes are corrupt, and not allocated
+	left := uint(len(r.data)) - offset
+	if (kind == mmdbMap && size > left/2) || (kind == mmdbArray && size > left) {
+		return nil, 0, errors.New("invalid MaxMind DB data: size beyond the end of the data")
+	}
+	switch kind {
+	case mmdbMap:
+		value := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := r.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value[fmt.Sprint(key)], offset, err = r.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbArray:
+		value := make([]interface{}, size)
+		for i := range value {
+			var err error
+			value[i], offset, err = r.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(r.data)) {
+		return nil, 0, errors.New("invalid MaxMind DB data")
+	}
+	b := r.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte{}, b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid MaxMind DB double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid MaxMind DB float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		value := uint64(0)
+		for _, n := range b {
+			value = value<<8 | uint64(n)
+		}
+		return value, offset, nil
+	case mmdbInt32:
+		value := uint32(0)
+		for _, n := range b {
+			value = value<<8 | uint32(n)
+		}
+		return int64(int32(value)), offset, nil
+	}
+	return nil, 0, errors.New(fmt.Sprintf("unsupported MaxMind DB data type %d", kind))
+}
+
+// pointer decodes a pointer, returning where it points to and the offset following it.
+func (r *mmdbReader) pointer(control byte, offset uint) (uint, uint, error) {
+	n := uint((control>>3)&0x3) + 1 // Bytes of the pointer
+	if offset+n > uint(len(r.data)) {
+		return 0, 0, errors.New("invalid MaxMind DB pointer")
+	}
+	value := uint(0)
+	if n < 4 {
+		value = uint(control & 0x7)
+	}
+	for _, b := range r.data[offset : offset+n] {
+		value = value<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		value += 2048
+	case 3:
+		value += 526336
+	}
+	return value, offset + n, nil
+}
+
+// uintField returns the unsigned integer in a decoded map, or zero.
+func uintField(fields map[string]interface{}, key string) uint {
+	value, _ := fields[key].(uint64)
+	return uint(value)
+}
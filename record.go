@@ -6,14 +6,38 @@ import (
 	"time"
 )
 
+// RecordVersion is the version of the format of the records written by this library.
+// Version 0 records were just an expiration timestamp, version 1 records had
+// no metadata (source, rule, creation and update time, hits, tags and meta).
+const RecordVersion = 2
+
 // Record is a struct containing the essential properties for a blacklisted record.
 // IP: the IP or CIDR it applies to.
 // ExpirationTime: the time after which the blacklisting is considered no longer applying.
 // Description: an optional description documenting the source of blacklisting.
+// Country, ASN and Organization: where the IP comes from, if known (see Enricher).
+// Version: the version of the format the record was written with.
+// Source: what created the record (e.g. a log file or an imported list).
+// Rule: the name of the rule that created the record, if any.
+// CreatedAt and UpdatedAt: when the record was first added and last extended.
+// Hits: how many times the record was added or extended while active.
+// Tags: labels for grouping records (e.g. "ssh" or "feed:spamhaus").
+// Meta: arbitrary key/value pairs.
 type Record struct {
 	IP             string
 	ExpirationTime time.Time
 	Description    string
+	Country        string `json:",omitempty"`
+	ASN            uint   `json:",omitempty"`
+	Organization   string `json:",omitempty"`
+	Version        int    `json:",omitempty"`
+	Source         string `json:",omitempty"`
+	Rule           string `json:",omitempty"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Hits           int               `json:",omitempty"`
+	Tags           []string          `json:",omitempty"`
+	Meta           map[string]string `json:",omitempty"`
 }
 
 func New(IP string, TTL time.Duration, description string) (r Record, err error) {
@@ -29,12 +53,66 @@ func New(IP string, TTL time.Duration, description string) (r Record, err error)
 			r.IP = ip
 			r.ExpirationTime = expirationTime
 			r.Description = strings.TrimSpace(description)
+			r.Version = RecordVersion
+			r.CreatedAt = now
+			r.UpdatedAt = now
+			r.Hits = 1
 		}
 		// If it's not valid, we use the error message from IsValid
 	}
 	return r, err
 }
 
+// AddTags adds the given tags to the record, skipping empty and repeated ones.
+func (r *Record) AddTags(tags ...string) {
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if len(tag) > 0 && !r.HasTag(tag) {
+			r.Tags = append(r.Tags, tag)
+		}
+	}
+}
+
+// HasTag returns if the record has the given tag.
+func (r *Record) HasTag(tag string) bool {
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMeta sets a key/value pair in the metadata of the record.
+func (r *Record) SetMeta(key string, value string) {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+	r.Meta[key] = value
+}
+
+// merge carries over the history of the given (older, still active) record:
+// its creation time, hits, tags and metadata (unless overwritten).
+func (r *Record) merge(old Record) {
+	if !old.CreatedAt.IsZero() && (r.CreatedAt.IsZero() || old.CreatedAt.Before(r.CreatedAt)) {
+		r.CreatedAt = old.CreatedAt
+	}
+	hits := r.Hits
+	if hits == 0 {
+		hits = 1
+	}
+	r.Hits = old.Hits + hits
+	tags := r.Tags
+	r.Tags = nil
+	r.AddTags(old.Tags...)
+	r.AddTags(tags...)
+	for k, v := range old.Meta {
+		if _, ok := r.Meta[k]; !ok {
+			r.SetMeta(k, v)
+		}
+	}
+}
+
 // IsValid returns if the record has a valid IP *and* it's not expired yet.
 func (r *Record) IsValid() bool {
 	valid := false // Default to false
@@ -0,0 +1,363 @@
+package gblist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SnapshotVersion is the version of the format of the snapshots written by
+// ExportSnapshot; ImportSnapshot reads this one and the older ones.
+const SnapshotVersion = 1
+
+// Snapshot is the portable content of a database, for moving it between
+// hosts and versions: every bucket, with its history, and the allowlist.
+// Its field names are fixed, whatever the names (and the encoding) of the
+// fields in the database.
+type Snapshot struct {
+	SchemaVersion int               `json:"schema_version"`
+	ExportedAt    time.Time         `json:"exported_at"`
+	Buckets       []BucketSnapshot  `json:"buckets"`
+	Allowlist     []AllowedSnapshot `json:"allowlist"`
+}
+
+// BucketSnapshot is the content of a bucket in a snapshot; Records include
+// the expired ones not purged yet.
+type BucketSnapshot struct {
+	Name    string           `json:"name"`
+	Records []RecordSnapshot `json:"records"`
+	History []EventSnapshot  `json:"history"`
+}
+
+// RecordSnapshot is a record in a snapshot
+type RecordSnapshot struct {
+	IP             string            `json:"ip"`
+	ExpirationTime time.Time         `json:"expiration_time"`
+	Description    string            `json:"description"`
+	Country        string            `json:"country,omitempty"`
+	ASN            uint              `json:"asn,omitempty"`
+	Organization   string            `json:"organization,omitempty"`
+	Source         string            `json:"source,omitempty"`
+	Rule           string            `json:"rule,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	Hits           int               `json:"hits,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	Meta           map[string]string `json:"meta,omitempty"`
+}
+
+// EventSnapshot is an event of the history in a snapshot
+type EventSnapshot struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Actor          string    `json:"actor"`
+	IP             string    `json:"ip"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	Description    string    `json:"description"`
+}
+
+// AllowedSnapshot is an entry of the allowlist in a snapshot
+type AllowedSnapshot struct {
+	IP          string    `json:"ip"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newRecordSnapshot(record Record) RecordSnapshot {
+	return RecordSnapshot{
+		IP:             record.IP,
+		ExpirationTime: record.ExpirationTime,
+		Description:    record.Description,
+		Country:        record.Country,
+		ASN:            record.ASN,
+		Organization:   record.Organization,
+		Source:         record.Source,
+		Rule:           record.Rule,
+		CreatedAt:      record.CreatedAt,
+		UpdatedAt:      record.UpdatedAt,
+		Hits:           record.Hits,
+		Tags:           record.Tags,
+		Meta:           record.Meta,
+	}
+}
+
+// record returns the record, in the current format
+func (r RecordSnapshot) record() Record {
+	return Record{
+		IP:             r.IP,
+		ExpirationTime: r.ExpirationTime,
+		Description:    r.Description,
+		Country:        r.Country,
+		ASN:            r.ASN,
+		Organization:   r.Organization,
+		Version:        RecordVersion,
+		Source:         r.Source,
+		Rule:           r.Rule,
+		CreatedAt:      r.CreatedAt,
+		UpdatedAt:      r.UpdatedAt,
+		Hits:           r.Hits,
+		Tags:           r.Tags,
+		Meta:           r.Meta,
+	}
+}
+
+// Backup writes a consistent copy of the database file, taken in a read
+// transaction, so that the storage can be written to at the same time.
+func (s *Storage) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupHandler returns a handler serving a backup of the database
+func BackupHandler(s *Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := s.view(func(tx *bolt.Tx) error {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="gblist.db"`)
+			w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+			_, err := tx.WriteTo(w)
+			return err
+		})
+		if err != nil {
+			// Most likely the headers are already sent; the client gets a short body
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Restore replaces the whole content of the database (buckets, history and
+// allowlist) with that of a backup file, in a single transaction. Watchers
+// are not notified.
+func (s *Storage) Restore(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if current, err := filepath.Abs(s.Database.Path()); err == nil && current == abs {
+		return errors.New(fmt.Sprintf("cannot restore %s onto itself", path))
+	}
+	backup, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to open backup %s: %s", path, err.Error()))
+	}
+	defer backup.Close()
+	return backup.View(func(src *bolt.Tx) error {
+		return s.update(func(tx *bolt.Tx) error {
+			err := clearDatabase(tx)
+			if err != nil {
+				return err
+			}
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				dst, err := tx.CreateBucket(name)
+				if err == nil {
+					err = copyTree(b, dst)
+				}
+				return err
+			})
+		})
+	})
+}
+
+// clearDatabase deletes every bucket, reserved ones included
+func clearDatabase(tx *bolt.Tx) error {
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		err = tx.DeleteBucket(name)
+	}
+	return err
+}
+
+// copyTree copies the content of a bucket, with its nested buckets and
+// sequence, into another
+func copyTree(src *bolt.Bucket, dst *bolt.Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucket(k)
+		if err == nil {
+			err = copyTree(src.Bucket(k), nested)
+		}
+		return err
+	})
+}
+
+// ExportSnapshot writes the content of the database as a JSON snapshot
+func (s *Storage) ExportSnapshot(w io.Writer) error {
+	snapshot := Snapshot{
+		SchemaVersion: SnapshotVersion,
+		ExportedAt:    time.Now().UTC(),
+		Buckets:       []BucketSnapshot{},
+		Allowlist:     []AllowedSnapshot{},
+	}
+	err := s.view(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if isReserved(string(name)) {
+				return nil
+			}
+			bucket := BucketSnapshot{Name: string(name), Records: []RecordSnapshot{}, History: []EventSnapshot{}}
+			err := b.ForEach(func(k, v []byte) error {
+				record, err := decodeRecord(k, v)
+				if err == nil {
+					bucket.Records = append(bucket.Records, newRecordSnapshot(record))
+				}
+				return nil // Not worth carrying over
+			})
+			if history := tx.Bucket([]byte(historyBucket)); err == nil && history != nil {
+				if events := history.Bucket(name); events != nil {
+					err = events.ForEach(func(k, v []byte) error {
+						var event Event
+						if json.Unmarshal(v, &event) == nil {
+							bucket.History = append(bucket.History, EventSnapshot(event))
+						}
+						return nil
+					})
+				}
+			}
+			snapshot.Buckets = append(snapshot.Buckets, bucket)
+			return err
+		})
+		if b := tx.Bucket([]byte(allowlistBucket)); err == nil && b != nil {
+			err = b.ForEach(func(k, v []byte) error {
+				var entry Allowed
+				if json.Unmarshal(v, &entry) == nil {
+					snapshot.Allowlist = append(snapshot.Allowlist, AllowedSnapshot(entry))
+				}
+				return nil
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&snapshot)
+}
+
+// ImportSnapshot reads a JSON snapshot into the database, in a single
+// transaction, returning the number of records written. With replace the
+// content of the database is replaced, history included; otherwise the
+// records replace those with the same IP, the allowlist entries are added
+// and the history of the snapshot is ignored. Records are written as they
+// are, without recording the changes nor notifying the watchers.
+func (s *Storage) ImportSnapshot(r io.Reader, replace bool) (int, error) {
+	var snapshot Snapshot
+	err := json.NewDecoder(r).Decode(&snapshot)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("failed to parse snapshot: %s", err.Error()))
+	}
+	if snapshot.SchemaVersion < 1 || snapshot.SchemaVersion > SnapshotVersion {
+		return 0, errors.New(fmt.Sprintf("unsupported snapshot schema version %d (the latest supported is %d)", snapshot.SchemaVersion, SnapshotVersion))
+	}
+	count := 0
+	for _, bucket := range snapshot.Buckets {
+		if len(bucket.Name) == 0 || isReserved(bucket.Name) {
+			return 0, errors.New(fmt.Sprintf("invalid bucket name %q in snapshot", bucket.Name))
+		}
+		for _, record := range bucket.Records {
+			if valid, err := IsValid(record.IP); !valid {
+				return 0, errors.New(fmt.Sprintf("invalid record in bucket %s: %s", bucket.Name, err.Error()))
+			}
+		}
+		count += len(bucket.Records)
+	}
+	err = s.update(func(tx *bolt.Tx) error {
+		if replace {
+			err := clearDatabase(tx)
+			if err != nil {
+				return err
+			}
+		}
+		for _, bucket := range snapshot.Buckets {
+			err := importBucket(tx, bucket, replace)
+			if err != nil {
+				return err
+			}
+		}
+		if len(snapshot.Allowlist) == 0 {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(allowlistBucket))
+		for _, entry := range snapshot.Allowlist {
+			if err != nil {
+				break
+			}
+			var payload []byte
+			allowed := Allowed(entry)
+			payload, err = json.Marshal(&allowed)
+			if err == nil {
+				err = b.Put([]byte(entry.IP), payload)
+			}
+		}
+		return err
+	})
+	return count, err
+}
+
+// importBucket writes the records of a bucket snapshot and, if asked, its history
+func importBucket(tx *bolt.Tx, bucket BucketSnapshot, history bool) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket.Name))
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range bucket.Records {
+		record := snapshot.record()
+		payload, err := json.Marshal(&record)
+		if err == nil {
+			err = b.Put([]byte(record.IP), payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !history || len(bucket.History) == 0 {
+		return nil
+	}
+	parent, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+	if err != nil {
+		return err
+	}
+	events, err := parent.CreateBucketIfNotExists([]byte(bucket.Name))
+	if err != nil {
+		return err
+	}
+	for _, event := range bucket.History {
+		sequence, err := events.NextSequence()
+		var payload []byte
+		if err == nil {
+			stored := Event(event)
+			payload, err = json.Marshal(&stored)
+		}
+		if err == nil {
+			err = events.Put(historyKey(sequence), payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
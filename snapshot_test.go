@@ -0,0 +1,347 @@
+package gblist
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const BACKUP = "test-backup.db"
+
+func TestStorage_Backup(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.1", "backed up", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Allow("198.51.100.1", "office")
+	if err != nil {
+		t.Error(err)
+	}
+	file, err := os.Create(BACKUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Backup(file)
+	file.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.Add(BUCKET, createRecord("192.0.2.2", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add("other", createRecord("203.0.113.1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Restore(BACKUP)
+	if err != nil {
+		t.Error(err)
+	}
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].IP != "192.0.2.1" || list[0].Description != "backed up" {
+		t.Errorf("wrong records after restore %+v", list)
+	}
+	names, err := s.Buckets()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("wrong buckets after restore %v", names)
+	}
+	events, err := s.History(BUCKET, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 1 || events[0].IP != "192.0.2.1" {
+		t.Errorf("wrong history after restore %+v", events)
+	}
+	allowed, err := s.IsAllowed("198.51.100.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !allowed {
+		t.Errorf("allowlist not restored")
+	}
+	// The history goes on from the restored sequence
+	err = s.Add(BUCKET, createRecord("192.0.2.3", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	events, err = s.History(BUCKET, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("wrong history after adding %+v", events)
+	}
+	err = s.Restore(DB)
+	if err == nil {
+		t.Errorf("database restored onto itself")
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+	err = os.Remove(BACKUP)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorage_ImportSnapshot(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.1", "exported", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add("other", createRecord("2001:db8::1", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Allow("198.51.100.1", "office")
+	if err != nil {
+		t.Error(err)
+	}
+	var snapshot bytes.Buffer
+	err = s.ExportSnapshot(&snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+	exported := snapshot.String()
+	if !strings.Contains(exported, `"schema_version": 1`) {
+		t.Errorf("missing schema version in:\n%s", exported)
+	}
+	if strings.Contains(exported, historyBucket) || strings.Contains(exported, allowlistBucket) {
+		t.Errorf("reserved buckets exported as buckets:\n%s", exported)
+	}
+
+	// Merge: the records of the snapshot replace those with the same IP
+	err = s.Add(BUCKET, createRecord("192.0.2.1", "changed", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, createRecord("192.0.2.2", "", ttl, t))
+	if err != nil {
+		t.Error(err)
+	}
+	count, err := s.ImportSnapshot(strings.NewReader(exported), false)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 2 {
+		t.Errorf("wrong number of records imported %d", count)
+	}
+	record, err := s.Fetch(BUCKET, "192.0.2.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if record.Description != "exported" {
+		t.Errorf("record not replaced %+v", record)
+	}
+	list, err := s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("wrong number of records after merging %d", len(list))
+	}
+
+	// Replace: the database is as exported, history included
+	count, err = s.ImportSnapshot(strings.NewReader(exported), true)
+	if err != nil {
+		t.Error(err)
+	}
+	list, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].IP != "192.0.2.1" {
+		t.Errorf("wrong records after replacing %+v", list)
+	}
+	events, err := s.History(BUCKET, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("wrong history after replacing %+v", events)
+	}
+	list, err = s.List("other")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 || list[0].IP != "2001:db8::1" {
+		t.Errorf("wrong records in other bucket %+v", list)
+	}
+	allowed, err := s.IsAllowed("198.51.100.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !allowed {
+		t.Errorf("allowlist not imported")
+	}
+
+	newer := strings.Replace(exported, `"schema_version": 1`, `"schema_version": 99`, 1)
+	_, err = s.ImportSnapshot(strings.NewReader(newer), true)
+	if err == nil {
+		t.Errorf("newer schema version imported")
+	}
+	invalid := strings.Replace(exported, `"192.0.2.1"`, `"192.0.2.300"`, 1)
+	_, err = s.ImportSnapshot(strings.NewReader(invalid), false)
+	if err == nil {
+		t.Errorf("invalid IP imported")
+	}
+	list, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("failed import changed the database %+v", list)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// snapshotFixture is a snapshot as written by ExportSnapshot, but for the
+// time of the export
+const snapshotFixture = `{
+  "schema_version": 1,
+  "exported_at": "2030-01-01T00:00:00Z",
+  "buckets": [
+    {
+      "name": "mail",
+      "records": [
+        {
+          "ip": "192.0.2.0/24",
+          "expiration_time": "2030-01-02T03:04:05Z",
+          "description": "lost connection after EHLO",
+          "country": "IT",
+          "asn": 64512,
+          "organization": "Example Org",
+          "source": "/var/log/mail.log",
+          "rule": "sasl",
+          "created_at": "2029-12-31T00:00:00Z",
+          "updated_at": "2030-01-01T00:00:00Z",
+          "hits": 2,
+          "tags": [
+            "mail",
+            "smtp"
+          ],
+          "meta": {
+            "port": "25",
+            "user": "admin"
+          }
+        },
+        {
+          "ip": "2001:db8::1",
+          "expiration_time": "2020-01-01T00:00:00Z",
+          "description": "expired, not purged yet",
+          "created_at": "2019-12-31T00:00:00Z",
+          "updated_at": "2019-12-31T00:00:00Z",
+          "hits": 1
+        }
+      ],
+      "history": [
+        {
+          "time": "2029-12-31T00:00:00Z",
+          "action": "add",
+          "actor": "goat-filter",
+          "ip": "192.0.2.0/24",
+          "expiration_time": "2030-01-01T03:04:05Z",
+          "description": "lost connection after EHLO"
+        },
+        {
+          "time": "2030-01-01T00:00:00Z",
+          "action": "extend",
+          "actor": "goat-filter",
+          "ip": "192.0.2.0/24",
+          "expiration_time": "2030-01-02T03:04:05Z",
+          "description": "lost connection after EHLO"
+        }
+      ]
+    }
+  ],
+  "allowlist": [
+    {
+      "ip": "198.51.100.0/24",
+      "description": "office",
+      "created_at": "2029-01-01T00:00:00Z"
+    }
+  ]
+}
+`
+
+func TestStorage_Snapshot_Fixture(t *testing.T) {
+	s, err := Open(DB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.ImportSnapshot(strings.NewReader(snapshotFixture), true)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 2 {
+		t.Errorf("wrong number of records imported %d", count)
+	}
+	record, err := s.Fetch("mail", "192.0.2.0/24")
+	if err != nil {
+		t.Error(err)
+	}
+	if record.Country != "IT" || record.ASN != 64512 || record.Hits != 2 || record.Meta["user"] != "admin" || record.Version != RecordVersion {
+		t.Errorf("wrong record imported %+v", record)
+	}
+	var exported bytes.Buffer
+	err = s.ExportSnapshot(&exported)
+	if err != nil {
+		t.Error(err)
+	}
+	// The time of the export is the only difference
+	lines := strings.SplitAfter(exported.String(), "\n")
+	if len(lines) > 2 && strings.HasPrefix(lines[2], `  "exported_at": "`) {
+		lines[2] = `  "exported_at": "2030-01-01T00:00:00Z",` + "\n"
+	}
+	if roundTrip := strings.Join(lines, ""); roundTrip != snapshotFixture {
+		t.Errorf("wrong snapshot exported:\n%s", roundTrip)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
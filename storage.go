@@ -12,40 +12,115 @@ import (
 	"time"
 )
 
+// Storage is a Bolt DB database of blacklisted records, divided in buckets.
+// Actor: who is making the changes, as written in the history.
+// HistoryMaxAge and HistoryMaxEvents: the retention limits of the history
+// of each bucket (zero for no limit).
+// Metrics: if set, what the storage does is counted there.
 type Storage struct {
-	Database *bolt.DB
-	TTL      time.Duration
+	Database         *bolt.DB
+	TTL              time.Duration
+	Actor            string
+	HistoryMaxAge    time.Duration
+	HistoryMaxEvents int
+	Metrics          *Metrics
+	watchers         *watchers
+	dryRun           *dryRun
 }
 
-// Opens a Bolt DB database at the given path
+// ErrLocked is returned by OpenTimeout when the database is still open in
+// another process (which holds an exclusive lock on it) after the timeout.
+var ErrLocked = errors.New("the database is in use by another process")
+
+// Opens a Bolt DB database at the given path, waiting for as long as it is
+// open in another process.
 func Open(path string, ttl time.Duration) (Storage, error) {
-	db, err := bolt.Open(path, 0600, nil)
+	return OpenTimeout(path, ttl, 0)
+}
+
+// OpenTimeout opens a Bolt DB database at the given path, failing with
+// ErrLocked if another process keeps it open for longer than the timeout
+// (zero for waiting for ever).
+func OpenTimeout(path string, ttl time.Duration, timeout time.Duration) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err == bolt.ErrTimeout {
+		err = ErrLocked
+	}
 	s := Storage{
-		Database: db,
-		TTL:      ttl,
+		Database:         db,
+		TTL:              ttl,
+		HistoryMaxAge:    DefaultHistoryMaxAge,
+		HistoryMaxEvents: DefaultHistoryMaxEvents,
+		watchers:         &watchers{},
 	}
 	return s, err
 }
 
 // Add insert or replace an IP address in the given bucket.
+// It fails if the IP is in the allowlist.
 func (s *Storage) Add(bucket string, record Record) error {
 	valid, err := IsValid(record.IP) // Double checking this, as the property is public.
 	if valid {
-		err = s.Database.Update(func(tx *bolt.Tx) error {
+		err = s.update(func(tx *bolt.Tx) error {
+			allowed := loadAllowlist(tx)
+			if allowed.contains(record.IP) {
+				return &AllowlistError{IPs: []string{record.IP}}
+			}
 			b, err := tx.CreateBucketIfNotExists([]byte(bucket))
 			if err != nil {
 				log.Fatal(err)
 			}
-			payload, err := json.Marshal(&record)
-			if err == nil {
-				err = b.Put([]byte(record.IP), payload)
-			}
+			_, err = s.put(tx, bucket, b, record, allowed)
 			return err
 		})
 	}
 	return err
 }
 
+// put stores the record in the given bucket, recording the event in its
+// history; it returns if the record replaced a non expired one.
+// Records in the allowlist (loaded once per transaction by the caller) are
+// silently skipped.
+func (s *Storage) put(tx *bolt.Tx, bucket string, b *bolt.Bucket, record Record, allowed allowlist) (bool, error) {
+	if isReserved(bucket) {
+		return false, errors.New(fmt.Sprintf("bucket %s is reserved", bucket))
+	}
+	if allowed.contains(record.IP) {
+		return false, nil
+	}
+	extended := false
+	existing := b.Get([]byte(record.IP))
+	if existing != nil {
+		old, err := decodeRecord([]byte(record.IP), existing)
+		extended = err == nil && old.IsValid()
+		if extended {
+			record.merge(old)
+		}
+	}
+	record.Version = RecordVersion
+	if record.UpdatedAt.IsZero() {
+		record.UpdatedAt = time.Now()
+	}
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = record.UpdatedAt
+	}
+	if record.Hits == 0 {
+		record.Hits = 1
+	}
+	payload, err := json.Marshal(&record)
+	if err == nil {
+		err = b.Put([]byte(record.IP), payload)
+	}
+	if err == nil {
+		action := ActionAdd
+		if extended {
+			action = ActionExtend
+		}
+		err = s.logChange(tx, bucket, action, record)
+	}
+	return extended, err
+}
+
 // List returns all the IP addresses from the given bucket that have not expired yet
 // and purges the expired records from the database.
 func (s *Storage) List(bucket string) ([]Record, error) {
@@ -53,27 +128,50 @@ func (s *Storage) List(bucket string) ([]Record, error) {
 	var purge []string
 	now := time.Now()
 	records, err := s.Dump(bucket)
-	if err == nil {
-		for _, record := range records {
-			if now.Before(record.ExpirationTime) {
-				list = append(list, record)
-			} else {
-				purge = append(purge, record.IP)
-			}
+	if err != nil {
+		return list, err
+	}
+	for _, record := range records {
+		if now.Before(record.ExpirationTime) {
+			list = append(list, record)
+		} else {
+			purge = append(purge, record.IP)
 		}
 	}
-	err = s.Purge(bucket, purge...)
-	return list, err
+	purgeErr := s.remove(bucket, ActionExpire, purge...)
+	return list, purgeErr
 }
 
 // Purge removes records from the database
 func (s *Storage) Purge(bucket string, addresses ...string) error {
-	err := s.Database.Update(func(tx *bolt.Tx) error {
+	return s.remove(bucket, ActionRemove, addresses...)
+}
+
+// remove deletes records from the bucket, recording the given action in the
+// history. Records being expired are left alone if, in the meantime, they
+// have been extended.
+func (s *Storage) remove(bucket string, action string, addresses ...string) error {
+	if len(addresses) == 0 && action == ActionExpire {
+		return nil // Nothing expired; no need to check the bucket
+	}
+	err := s.update(func(tx *bolt.Tx) error {
 		var err error
 		b := tx.Bucket([]byte(bucket))
 		if b != nil {
 			for _, ip := range addresses {
+				payload := b.Get([]byte(ip))
+				if payload == nil {
+					continue
+				}
+				record, _ := decodeRecord([]byte(ip), payload)
+				if action == ActionExpire && record.IsValid() {
+					continue
+				}
+				record.IP = ip
 				err = b.Delete([]byte(ip))
+				if err == nil {
+					err = s.logChange(tx, bucket, action, record)
+				}
 				if err != nil {
 					break
 				}
@@ -86,33 +184,34 @@ func (s *Storage) Purge(bucket string, addresses ...string) error {
 	return err
 }
 
-// Close closes the Bolt database
+// Close closes the Bolt database (discarding the changes of a dry run), and
+// the channels of the watchers
 func (s *Storage) Close() error {
+	s.unwatchAll()
+	err := s.rollback()
+	if err != nil {
+		s.Database.Close()
+		return err
+	}
 	return s.Database.Close()
 }
 
-// Dump returns a slice of the current (valid) IPs in the bucket and purges invalid ones
+// Dump returns a slice of the current (valid) IPs in the bucket and purges invalid ones.
+// Records in the allowlist are left out.
 func (s *Storage) Dump(bucket string) ([]Record, error) {
 	var entries []Record
 	var purge []string
-	err := s.Database.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b != nil {
+			allowed := loadAllowlist(tx)
 			b.ForEach(func(k, v []byte) error {
-				var record Record
-				parseErr := json.Unmarshal(v, &record)
-				if parseErr != nil {
-					// Compatibility check with older format, where the value was just a timestamp
-					unixTimestamp, timeError := strconv.ParseInt(string(v), 10, 64)
-					if timeError == nil {
-						record.IP = string(k)
-						record.ExpirationTime = time.Unix(unixTimestamp, 0)
-						parseErr = nil
-					}
-				}
+				record, parseErr := decodeRecord(k, v)
 				valid, _ := IsValid(record.IP)
 				if valid && parseErr == nil {
-					entries = append(entries, record)
+					if !allowed.contains(record.IP) {
+						entries = append(entries, record)
+					}
 				} else {
 					purge = append(purge, string(k))
 				}
@@ -121,30 +220,61 @@ func (s *Storage) Dump(bucket string) ([]Record, error) {
 		}
 		return nil
 	})
-	err = s.Purge(bucket, purge...)
+	err = s.remove(bucket, ActionRemove, purge...)
 	return entries, err
 }
 
 // Fetch tries to fetch a record from the given IP and bucket.
 // The function does not return an error if the record is not present,
 // as it's not properly an error (may add a bool in the return, for
-// such a case), but the record is not a valid one.
+// such a case), but the record is not a valid one; the same goes for
+// records in the allowlist.
 // See: Record.IsValid()
 func (s *Storage) Fetch(bucket string, ip string) (Record, error) {
 	var record Record
-	err := s.Database.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		var err error
 		b := tx.Bucket([]byte(bucket))
 		if b != nil {
 			payload := b.Get([]byte(ip))
-			if payload != nil {
-				err = json.Unmarshal(payload, &record)
+			if payload != nil && !loadAllowlist(tx).contains(ip) {
+				record, err = decodeRecord([]byte(ip), payload)
 			}
 		} else {
 			err = errors.New(fmt.Sprintf("no %s bucket found", bucket))
 		}
 		return err
 	})
+	if s.Metrics != nil {
+		s.Metrics.lookup(bucket, err == nil && record.IsValid())
+	}
+	return record, err
+}
+
+// decodeRecord parses a stored value into a record.
+// Values written by older versions were just a UNIX timestamp, in which case
+// the key is used as IP; the Version of the record tells which format it was
+// stored with.
+func decodeRecord(k, v []byte) (Record, error) {
+	var record Record
+	err := json.Unmarshal(v, &record)
+	if err != nil {
+		// Compatibility check with older format, where the value was just a timestamp
+		unixTimestamp, timeError := strconv.ParseInt(string(v), 10, 64)
+		if timeError == nil {
+			record = Record{
+				IP:             string(k),
+				ExpirationTime: time.Unix(unixTimestamp, 0),
+				Version:        0,
+			}
+			err = nil
+		}
+	} else if record.Version == 0 {
+		record.Version = 1 // JSON without metadata
+	}
+	if err == nil && record.Hits == 0 {
+		record.Hits = 1 // Older records were added at least once
+	}
 	return record, err
 }
 
@@ -1,7 +1,10 @@
 package gblist
 
 import (
+	"fmt"
+	"github.com/boltdb/bolt"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -22,6 +25,26 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestOpenTimeout(t *testing.T) {
+	s, err := Open(DB, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(DB)
+	// Bolt locks the file, so even from the same process
+	_, err = OpenTimeout(DB, 0, 50*time.Millisecond)
+	if err != ErrLocked {
+		t.Errorf("wrong error opening a database in use: %v", err)
+	}
+	s.Close()
+	s, err = OpenTimeout(DB, 0, 50*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	} else {
+		s.Close()
+	}
+}
+
 func TestStorage_Add(t *testing.T) {
 	ttl, err := time.ParseDuration("10m")
 	if err != nil {
@@ -97,6 +120,11 @@ func TestStorage_List(t *testing.T) {
 		t.Error(err)
 	}
 
+	_, err = s.List("missing")
+	if err == nil {
+		t.Error("listing a missing bucket did not fail")
+	}
+
 	time.Sleep(time.Duration(5))
 	list, err := s.List(BUCKET)
 	if err != nil {
@@ -176,6 +204,76 @@ func TestStorage_Purge(t *testing.T) {
 	}
 }
 
+func TestStorage_Legacy(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	expiration := time.Now().Add(ttl).Unix()
+	err = s.Database.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(BUCKET))
+		if err == nil {
+			err = b.Put([]byte("127.0.0.1"), []byte(strconv.FormatInt(expiration, 10)))
+		}
+		if err == nil {
+			v1 := fmt.Sprintf(`{"IP":"10.55.11.12","ExpirationTime":"%s","Description":"old"}`, time.Unix(expiration, 0).Format(time.RFC3339))
+			err = b.Put([]byte("10.55.11.12"), []byte(v1))
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	dump, err := s.Dump(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(dump) != 2 {
+		t.Fatalf("wrong number of elements %d", len(dump))
+	}
+	for _, record := range dump {
+		if record.ExpirationTime.Unix() != expiration || record.Hits != 1 {
+			t.Errorf("wrong legacy record %+v", record)
+		}
+		if (record.IP == "127.0.0.1" && record.Version != 0) || (record.IP == "10.55.11.12" && record.Version != 1) {
+			t.Errorf("wrong version %d for %s", record.Version, record.IP)
+		}
+	}
+
+	// Extending a record keeps its history
+	r := createRecord("10.55.11.12", "new", ttl, t)
+	r.Source = "test"
+	r.AddTags("ssh")
+	r.SetMeta("key", "value")
+	err = s.Add(BUCKET, r)
+	if err != nil {
+		t.Error(err)
+	}
+	r = createRecord("10.55.11.12", "newer", ttl, t)
+	r.AddTags("smtp", "ssh")
+	err = s.Add(BUCKET, r)
+	if err != nil {
+		t.Error(err)
+	}
+	record, err := s.Fetch(BUCKET, r.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	if record.Version != RecordVersion || record.Hits != 3 || record.Description != "newer" ||
+		len(record.Tags) != 2 || !record.HasTag("smtp") || record.Meta["key"] != "value" {
+		t.Errorf("wrong extended record %+v", record)
+	}
+	s.Close()
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRecord_New(t *testing.T) {
 	_, err := New("8888", time.Duration(1000), "")
 	if err == nil {
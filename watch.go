@@ -0,0 +1,212 @@
+package gblist
+
+import (
+	"github.com/boltdb/bolt"
+	"sync"
+)
+
+// ChangeType is the kind of change notified to watchers.
+type ChangeType int
+
+// Types of change
+const (
+	Added   ChangeType = iota // A new record
+	Updated                   // A record replacing a non expired one
+	Removed                   // A record removed before its expiration time
+	Expired                   // An expired record purged from the database
+)
+
+// ChangeTypes are all the types of change
+var ChangeTypes = []ChangeType{Added, Updated, Removed, Expired}
+
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Updated:
+		return "updated"
+	case Removed:
+		return "removed"
+	case Expired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Action returns the action of the history (one of the Action constants)
+// the change is the result of.
+func (t ChangeType) Action() string {
+	for action, changeType := range changeTypes {
+		if changeType == t {
+			return action
+		}
+	}
+	return "unknown"
+}
+
+// Change is a change to a record, as notified to watchers.
+type Change struct {
+	Type   ChangeType
+	Bucket string
+	Record Record
+}
+
+// changeTypes maps the actions of the history to the types of change.
+var changeTypes = map[string]ChangeType{
+	ActionAdd:    Added,
+	ActionExtend: Updated,
+	ActionRemove: Removed,
+	ActionExpire: Expired,
+}
+
+// watchers are the subscribers to the changes of a database; they are
+// shared by all the copies of a Storage.
+type watchers struct {
+	mutex sync.Mutex
+	list  []*watcher
+}
+
+// watcher queues the changes for a subscriber, so that writers never
+// wait for a slow reader, and nothing gets lost.
+type watcher struct {
+	bucket  string
+	out     chan Change
+	mutex   sync.Mutex
+	queue   []Change
+	wake    chan struct{}
+	done    chan struct{} // Stop immediately
+	closing chan struct{} // Stop once the queue is empty
+}
+
+// Watch returns a channel receiving the changes to the records of the given
+// bucket (of all buckets, if empty), once they are committed.
+// The channel is closed by Unwatch or, after all the pending changes have
+// been received, when the storage is closed.
+func (s *Storage) Watch(bucket string) <-chan Change {
+	if s.watchers == nil {
+		s.watchers = &watchers{}
+	}
+	w := &watcher{
+		bucket:  bucket,
+		out:     make(chan Change),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	s.watchers.mutex.Lock()
+	s.watchers.list = append(s.watchers.list, w)
+	s.watchers.mutex.Unlock()
+	go w.run()
+	return w.out
+}
+
+// Unwatch stops the notifications to the given channel, closing it.
+func (s *Storage) Unwatch(changes <-chan Change) {
+	if s.watchers == nil {
+		return
+	}
+	s.watchers.mutex.Lock()
+	defer s.watchers.mutex.Unlock()
+	for i, w := range s.watchers.list {
+		if w.out == changes {
+			close(w.done)
+			s.watchers.list = append(s.watchers.list[:i], s.watchers.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// unwatchAll stops all the watchers, once they delivered the pending changes.
+func (s *Storage) unwatchAll() {
+	if s.watchers == nil {
+		return
+	}
+	s.watchers.mutex.Lock()
+	defer s.watchers.mutex.Unlock()
+	for _, w := range s.watchers.list {
+		close(w.closing)
+	}
+	s.watchers.list = nil
+}
+
+// notify queues the change for the watchers, once the transaction is committed;
+// during a dry run the change is just recorded.
+func (s *Storage) notify(tx *bolt.Tx, bucket string, action string, record Record) {
+	change := Change{
+		Type:   changeTypes[action],
+		Bucket: bucket,
+		Record: record,
+	}
+	if s.dryRun != nil {
+		// Never committed; the lock is held by update
+		s.dryRun.changes = append(s.dryRun.changes, change)
+		return
+	}
+	if s.Metrics != nil {
+		tx.OnCommit(func() {
+			s.Metrics.change(bucket, change.Type)
+		})
+	}
+	if s.watchers == nil {
+		return
+	}
+	tx.OnCommit(func() {
+		s.watchers.mutex.Lock()
+		defer s.watchers.mutex.Unlock()
+		for _, w := range s.watchers.list {
+			if len(w.bucket) == 0 || w.bucket == bucket {
+				w.push(change)
+			}
+		}
+	})
+}
+
+// logChange records the change in the history and notifies the watchers.
+func (s *Storage) logChange(tx *bolt.Tx, bucket string, action string, record Record) error {
+	err := s.appendHistory(tx, bucket, newEvent(action, s.Actor, record))
+	if err == nil {
+		s.notify(tx, bucket, action, record)
+	}
+	return err
+}
+
+// push queues a change
+func (w *watcher) push(change Change) {
+	w.mutex.Lock()
+	w.queue = append(w.queue, change)
+	w.mutex.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default: // Already awake
+	}
+}
+
+// run delivers the queued changes until the watcher is stopped.
+func (w *watcher) run() {
+	defer close(w.out)
+	for {
+		w.mutex.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+		for _, change := range queue {
+			select {
+			case w.out <- change:
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case <-w.wake:
+		case <-w.closing:
+			w.mutex.Lock()
+			empty := len(w.queue) == 0
+			w.mutex.Unlock()
+			if empty {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package gblist
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_Watch(t *testing.T) {
+	ttl, err := time.ParseDuration("10m")
+	if err != nil {
+		t.Error(err)
+	}
+	s, err := Open(DB, ttl)
+	if err != nil {
+		t.Error(err)
+	}
+	changes := s.Watch(BUCKET)
+	other := s.Watch("other")
+
+	r1 := createRecord("10.55.11.12", "", ttl, t)
+	r2 := createRecord("127.0.0.1", "", time.Duration(1), t)
+	err = s.AddBatch(BUCKET, []Record{r1, r2})
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Add(BUCKET, r1)
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.Purge(BUCKET, r1.IP)
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Duration(5))
+	_, err = s.List(BUCKET)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []Change{
+		{Added, BUCKET, r1},
+		{Added, BUCKET, r2},
+		{Updated, BUCKET, r1},
+		{Removed, BUCKET, r1},
+		{Expired, BUCKET, r2},
+	}
+	for _, e := range expected {
+		select {
+		case change := <-changes:
+			if change.Type != e.Type || change.Bucket != e.Bucket || change.Record.IP != e.Record.IP {
+				t.Errorf("expected %s %s, got %s %s", e.Type, e.Record.IP, change.Type, change.Record.IP)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing %s change for %s", e.Type, e.Record.IP)
+		}
+	}
+	select {
+	case change := <-other:
+		t.Errorf("unexpected change %+v", change)
+	default:
+	}
+
+	s.Unwatch(changes)
+	if _, open := <-changes; open {
+		t.Errorf("channel not closed")
+	}
+	s.Close()
+	if _, open := <-other; open {
+		t.Errorf("channel not closed")
+	}
+	err = os.Remove(DB)
+	if err != nil {
+		t.Error(err)
+	}
+}